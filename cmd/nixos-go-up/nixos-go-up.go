@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Meerschwein/nixos-go-up/pkg/command"
 	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+	"github.com/Meerschwein/nixos-go-up/pkg/events"
 	"github.com/Meerschwein/nixos-go-up/pkg/selection"
 	"github.com/Meerschwein/nixos-go-up/pkg/util"
 )
@@ -15,69 +25,354 @@ var (
 	dryRun     bool
 	toScript   bool
 	scriptname string
+	tpm2Device string
+	resume     bool
+	checkpoint string
+	logFile    string
+	hooksDir   string
+	rootSizeGB int
+	output     string
+	socket     string
+
+	// stream is only set for the JSON output
+	stream *events.Stream
 )
 
 func init() {
 	flag.BoolVar(&dryRun, "dry-run", false, "dry-run")
 	flag.BoolVar(&toScript, "to-script", false, "to-script")
 	flag.StringVar(&scriptname, "script-name", "nixos-install.sh", "script name")
+	flag.StringVar(&tpm2Device, "tpm2-device", "auto", "TPM2 device for systemd-cryptenroll, e.g. a swtpm")
+	flag.BoolVar(&resume, "resume", false, "resume a failed installation from its checkpoint")
+	flag.StringVar(&checkpoint, "checkpoint", command.CHECKPOINTFILE, "checkpoint file")
+	flag.StringVar(&logFile, "log", "/tmp/nixos-go-up.jsonl", "JSON lines execution log, copied to "+command.LOGDIR+" on the installed system")
+	flag.StringVar(&output, "output", "text", "text for a terminal or json events for a frontend, answers are read from stdin")
+	flag.StringVar(&socket, "socket", "", "unix socket to serve the json events and answers on instead of stdout and stdin")
+	flag.StringVar(&hooksDir, "hooks", command.HOOKSDIR, "directory with post-partition, post-mount and post-install hooks")
+	flag.IntVar(&rootSizeGB, "root-size", 0, "size of the root partition in GB, the rest of the disk is left free for hooks (0 fills the disk)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [cleanup [disk] | plan [file] | apply file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 
 	flag.Parse()
 
+	switch output {
+	case "text":
+	case "json":
+		setupEvents()
+	default:
+		util.ExitIfErr(fmt.Errorf("unknown output %s", output))
+	}
+
 	if !util.WasRunAsRoot() {
 		util.ExitIfErr(fmt.Errorf("run as root"))
 	}
 
-	if util.MountIsUsed() && !dryRun {
+	// A resumed installation and cleanup unmount the leftovers themselves
+	if util.MountIsUsed() && !dryRun && !resume && flag.Arg(0) != "cleanup" && flag.Arg(0) != "plan" {
 		util.ExitIfErr(fmt.Errorf("something is was found at /mnt"))
 	}
 }
 
+// setupEvents turns everything meant for the terminal into JSON events,
+// on stdout or the first connection to the socket
+func setupEvents() {
+	var w io.Writer = os.Stdout
+	var r io.Reader = os.Stdin
+	if socket != "" {
+		// Left over from an earlier run
+		if err := os.Remove(socket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			util.ExitIfErr(err)
+		}
+		l, err := net.Listen("unix", socket)
+		util.ExitIfErr(err)
+		conn, err := l.Accept()
+		util.ExitIfErr(err)
+		l.Close()
+		w, r = conn, conn
+	}
+
+	stream = events.NewStream(w, r)
+	selection.Events = stream
+	util.Out = stream.Writer(events.MESSAGE, "")
+	util.BeforeExit = closeEvents
+}
+
+// closeEvents sends the result and removes the socket
+func closeEvents(err error) {
+	stream.Result(err)
+	if socket != "" {
+		os.Remove(socket)
+	}
+}
+
 func main() {
+	if stream != nil {
+		defer closeEvents(nil)
+	}
+
+	if flag.Arg(0) == "cleanup" {
+		cleanup(flag.Arg(1))
+		return
+	}
+
+	if flag.Arg(0) == "apply" {
+		applyPlan(flag.Arg(1))
+		return
+	}
+
+	if resume {
+		resumeInstallation()
+		return
+	}
+
 	conf := configuration.Conf{}
 	conf = conf.SetFirmware()
 	conf.NetInterfaces = util.GetInterfaces()
+	conf.TPM2Device = tpm2Device
+	conf.HooksDir = hooksDir
+	conf.RootSizeGB = rootSizeGB
 
 	selectionSteps := []selection.SelectionStep{
 		selection.Disk,
-	}
-
-	// BIOS encryption is not supported at the moment
-	if conf.IsUEFI() {
-		selectionSteps = append(selectionSteps, selection.DiskEncryption)
-	}
-
-	selectionSteps = append(selectionSteps,
+		selection.DiskEncryption,
+		selection.LuksParameters,
+		selection.RecoveryPassphrase,
+		selection.LuksHeader,
+		selection.Discard,
+		selection.Layout,
+		selection.EncryptedBoot,
+		selection.MountOptions,
+		selection.SecureBoot,
 		selection.Hostname,
 		selection.Timezone,
 		selection.DesktopEnviroment,
 		selection.Keyboardlayout,
 		selection.Username,
 		selection.Password,
-	)
+	}
 
 	conf, err := selection.GetSelections(conf, selectionSteps)
 	util.ExitIfErr(err)
 
-	fmt.Printf("Your Selection so far:\n%v\n", conf)
+	// The boot partition takes up to 512MiB
+	if conf.RootSizeGB < 0 || (conf.RootSizeGB > 0 && conf.RootSizeGB >= conf.Disk.SizeGB) {
+		util.ExitIfErr(fmt.Errorf("a root partition of %dGB doesn't fit on %s (%dGB)", conf.RootSizeGB, conf.Disk.Name, conf.Disk.SizeGB))
+	}
+
+	if stream != nil {
+		stream.Emit(events.Event{Type: events.CONF, Configuration: command.WithoutSecrets(conf)})
+	} else {
+		fmt.Fprintf(util.Out, "Your Selection so far:\n%v\n", conf)
+	}
+
+	existing, err := disk.ExistingData(conf.Disk.Name)
+	if err != nil {
+		fmt.Fprintf(util.Out, "Couldn't list the existing partitions of %s: %v\n", conf.Disk.Name, err)
+	}
+	cmds, phases := command.GeneratePhases(conf, command.MakePhases(conf))
+	showPlan(command.Plan(conf, existing), cmds, phases)
+
+	if flag.Arg(0) == "plan" {
+		writePlan(conf, cmds, phases, flag.Arg(1))
+		return
+	}
 
 	cont := selection.ConfirmationDialog("Are you sure you want to continue?")
 	if !cont {
-		fmt.Println("Aborting...")
+		fmt.Fprintln(util.Out, "Aborting...")
 		return
 	}
 
-	gens := command.MakeCommandGenerators(conf)
-
-	cmds := command.GenerateCommands(conf, gens)
-
 	if dryRun {
 		command.DryRun(cmds)
 	} else if toScript {
 		script := command.ShellScript(cmds)
-		err := os.WriteFile(scriptname, []byte(script), 0o644)
+		err := os.WriteFile(scriptname, []byte(script), 0o700)
 		util.ExitIfErr(err)
 	} else {
-		command.RunCmds(cmds)
+		cp := command.NewCheckpoint(conf)
+		install("install", cmds, phases, &cp, map[string]string{}, conf)
+	}
+}
+
+func resumeInstallation() {
+	cp, err := command.LoadCheckpoint(checkpoint)
+	util.ExitIfErr(err)
+
+	fmt.Fprintf(util.Out, "Resuming the installation after step %d:\n%v\n", cp.Completed, cp.Conf)
+
+	conf, err := selection.GetSelections(cp.Conf, []selection.SelectionStep{
+		selection.EncryptionPassword,
+		selection.Password,
+	})
+	util.ExitIfErr(err)
+
+	cmds, phases, err := cp.ResumeCommands(conf)
+	util.ExitIfErr(err)
+
+	if dryRun {
+		command.DryRun(cmds)
+		return
+	}
+
+	install("resume", cmds, phases, &cp, cp.ResumeState(), cp.Conf)
+}
+
+// install runs the commands and tears down the disk on failure,
+// plans are applied without a checkpoint
+func install(run string, cmds []command.Command, phases []string, cp *command.Checkpoint, state map[string]string, conf configuration.Conf) {
+	diskName := conf.Disk.Name
+
+	// A resumed installation continues the log of the failed one
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if run == "resume" {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
 	}
+	f, err := os.OpenFile(logFile, flags, 0o600)
+	util.ExitIfErr(err)
+	defer f.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runner := command.Runner{
+		Executor: newExecutor(),
+		Log:      command.NewExecLog(f),
+		Phases:   phases,
+		Events:   stream,
+	}
+	runner.Log.Begin(run, time.Now())
+	if cp != nil {
+		runner.Done = cp.Track(checkpoint)
+	}
+
+	err = runner.Run(ctx, cmds, state)
+	stop()
+
+	if util.MountIsUsed() {
+		if err := command.CopyLog(logFile, command.LogDir(conf)); err != nil {
+			fmt.Fprintf(util.Out, "Couldn't copy the log to %s: %v\n", command.LogDir(conf), err)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(util.Out, "Installation failed: %v\nTearing down...\n", err)
+		if err := command.Teardown(context.Background(), runner, diskName); err != nil {
+			fmt.Fprintf(util.Out, "Teardown failed, finish it with \"%s cleanup %s\": %v\n", os.Args[0], diskName, err)
+		}
+	}
+
+	fmt.Fprint(util.Out, runner.Log.Summary())
+
+	if err != nil && cp != nil {
+		fmt.Fprintf(util.Out, "The log is at %s, rerun with -resume to continue from %s\n", logFile, checkpoint)
+	}
+	util.ExitIfErr(err)
+
+	for _, note := range command.SecureBootNotes(conf) {
+		fmt.Fprintln(util.Out, note)
+	}
+
+	if cp != nil {
+		util.ExitIfErr(os.Remove(checkpoint))
+	}
+}
+
+// writePlan saves the commands which were shown, generating them again would pick a new salt
+func writePlan(conf configuration.Conf, cmds []command.Command, phases []string, path string) {
+	if path == "" {
+		path = "nixos-go-up-plan.json"
+	}
+
+	id, err := disk.Identify(conf.Disk.Name)
+	util.ExitIfErr(err)
+
+	plan, err := command.NewPlanFile(conf, cmds, phases, []disk.Identity{id})
+	util.ExitIfErr(err)
+
+	util.ExitIfErr(plan.Save(path))
+	fmt.Fprintf(util.Out, "Wrote the plan to %s, run it with \"%s apply %s\"\n", path, os.Args[0], path)
+}
+
+func applyPlan(path string) {
+	if path == "" {
+		util.ExitIfErr(fmt.Errorf("apply needs a plan file"))
+	}
+
+	plan, err := command.LoadPlanFile(path)
+	util.ExitIfErr(err)
+
+	cmds, phases, err := plan.Commands()
+	util.ExitIfErr(err)
+
+	util.ExitIfErr(plan.VerifyDisks())
+
+	fmt.Fprintf(util.Out, "Applying %s:\n%v\n", path, plan.Conf)
+	showPlan(command.PlanSteps(cmds, phases), cmds, phases)
+
+	if !selection.ConfirmationDialog("Are you sure you want to continue?") {
+		fmt.Fprintln(util.Out, "Aborting...")
+		return
+	}
+
+	values := map[string]string{}
+	for _, s := range command.ScriptSecrets(cmds) {
+		values[s.Name] = s.Ask(selection.SecretDialog).Value
+	}
+	cmds = command.WithSecrets(cmds, values)
+
+	if dryRun {
+		command.DryRun(cmds)
+		return
+	}
+
+	install("apply", cmds, phases, nil, map[string]string{}, plan.Conf)
+}
+
+// cleanup tears down what a failed installation left behind, the disk
+// defaults to the one of the checkpoint
+func cleanup(diskName string) {
+	if diskName == "" {
+		if cp, err := command.LoadCheckpoint(checkpoint); err == nil {
+			diskName = cp.Conf.Disk.Name
+		}
+	}
+
+	runner := command.Runner{Executor: newExecutor(), Events: stream}
+	util.ExitIfErr(command.Teardown(context.Background(), runner, diskName))
+}
+
+// showPlan prints the plan, a frontend gets its sections as well
+func showPlan(plan string, cmds []command.Command, phases []string) {
+	if stream == nil {
+		fmt.Fprintf(util.Out, "\n%s\n", plan)
+		return
+	}
+
+	sections := []events.Section{}
+	for _, s := range command.PlanSections(cmds, phases) {
+		section := events.Section{Name: s.Name}
+		for _, cmd := range s.Cmds {
+			section.Steps = append(section.Steps, cmd.Message())
+		}
+		sections = append(sections, section)
+	}
+	stream.Emit(events.Event{Type: events.PLAN, Plan: plan, Sections: sections})
+}
+
+// newExecutor sends the output of the commands to the frontend,
+// stdin is reserved for the answers then
+func newExecutor() command.Executor {
+	executor := command.NewBashExecutor()
+	if stream == nil {
+		return executor
+	}
+
+	executor.Stdin = nil
+	executor.Stdout = stream.Writer(events.LOG, "stdout")
+	executor.Stderr = stream.Writer(events.LOG, "stderr")
+	return command.EventExecutor{BashExecutor: executor, Events: stream}
 }
@@ -3,7 +3,10 @@
   makeWrapper,
   lib,
   cryptsetup,
+  mkpasswd,
   parted,
+  qrencode,
+  sbctl,
   yubikey-personalization,
   callPackage,
 }:
@@ -16,8 +19,12 @@ buildGoModule rec {
   nativeBuildInputs = [makeWrapper];
 
   wrapperPath = lib.makeBinPath [
+    (callPackage ./pbkdf2-sha512.nix {})
     cryptsetup
+    mkpasswd
     parted
+    qrencode
+    sbctl
     yubikey-personalization
   ];
 
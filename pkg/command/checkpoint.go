@@ -0,0 +1,254 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+// CHECKPOINTFILE lives on the installation medium, never on the target disk
+const CHECKPOINTFILE = "/tmp/nixos-go-up-checkpoint.json"
+
+// Checkpoint records the progress of an installation, it doesn't contain any secrets
+type Checkpoint struct {
+	Conf configuration.Conf
+	// DiskCommands is the number of commands setting up the disk
+	DiskCommands int
+	Completed    int
+	// State holds the outputs of the completed commands which aren't sensitive,
+	// including the LUKS UUIDs
+	State map[string]string
+
+	// indices map the commands being run to the generated ones, -1 marks replayed ones
+	indices []int
+}
+
+func NewCheckpoint(conf configuration.Conf) Checkpoint {
+	return Checkpoint{
+		Conf:         WithoutSecrets(conf),
+		DiskCommands: len(GenerateCommands(conf, DiskGenerators(conf))),
+		State:        map[string]string{},
+	}
+}
+
+// WithoutSecrets clears everything which has to be asked for again when resuming
+func WithoutSecrets(conf configuration.Conf) configuration.Conf {
+	conf.Password = ""
+	conf.Disk.EncryptionPasswd = ""
+	conf.Disk.RecoveryPasswd = ""
+	conf.YubikeySecret = ""
+	return conf
+}
+
+func LoadCheckpoint(path string) (cp Checkpoint, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &cp)
+	if cp.State == nil {
+		cp.State = map[string]string{}
+	}
+	return
+}
+
+func (c Checkpoint) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Track is used as Runner.Done and saves the checkpoint after every generated command
+func (c *Checkpoint) Track(path string) func(i int, cmd Command, state map[string]string) {
+	return func(i int, cmd Command, state map[string]string) {
+		if c.indices != nil {
+			i = c.indices[i]
+		}
+		if i < 0 {
+			return
+		}
+
+		c.Completed = i + 1
+		if key, sensitive := output(cmd); key != "" {
+			if sensitive {
+				delete(c.State, key)
+			} else {
+				c.State[key] = state[key]
+			}
+		}
+
+		if err := c.Save(path); err != nil {
+			fmt.Fprintf(util.Out, "Couldn't save the checkpoint to %s: %v\n", path, err)
+		}
+	}
+}
+
+// output is the state key a command sets and whether its value must not be stored
+func output(cmd Command) (key string, sensitive bool) {
+	switch c := cmd.(type) {
+	case ShellCommand:
+		return c.OutLabel, c.Sensitive
+	case ExecCommand:
+		return c.OutLabel, c.Sensitive
+	case FuncCommand:
+		return c.OutLabel, len(c.Secrets) > 0
+	}
+	return "", false
+}
+
+// ResumeCommands reopen the disk and continue after the last completed command,
+// the secrets of the configuration have to be filled in again.
+// The phase of every command is returned as well.
+func (c *Checkpoint) ResumeCommands(conf configuration.Conf) (cmds []Command, phases []string, err error) {
+	if c.Completed < c.DiskCommands {
+		return nil, nil, fmt.Errorf("the disk setup didn't finish, start a new installation instead")
+	}
+
+	diskConf, _ := generate(conf, DiskGenerators(conf))
+	_, install, installPhases := generatePhases(diskConf, InstallPhases())
+
+	cmds = ReopenCommands(diskConf, c.State)
+	for range cmds {
+		c.indices = append(c.indices, -1)
+		phases = append(phases, PHASERESUME)
+	}
+
+	done := c.Completed - c.DiskCommands
+	if done > len(install) {
+		done = len(install)
+	}
+
+	// Unmounting destroyed the tmpfs root and /mnt/etc/nixos with it, it is
+	// restored once persisted and written again otherwise
+	restore := false
+	if conf.IsImpermanent() {
+		if persisted := labelIndex(install, PERSISTCONFIG); persisted >= 0 && persisted < done {
+			restore = true
+		} else if generated := labelIndex(install, GENERATECONFIG); generated >= 0 && generated < done {
+			done = generated
+		}
+	}
+
+	for i, cmd := range install[:done] {
+		if replayOnResume(cmd) {
+			cmds = append(cmds, cmd)
+			c.indices = append(c.indices, -1)
+			phases = append(phases, installPhases[i])
+		}
+	}
+
+	if restore {
+		for _, cmd := range RestoreNixosConfig() {
+			cmds = append(cmds, cmd)
+			c.indices = append(c.indices, -1)
+			phases = append(phases, PHASERESUME)
+		}
+	}
+
+	for i, cmd := range install[done:] {
+		cmds = append(cmds, cmd)
+		c.indices = append(c.indices, c.DiskCommands+done+i)
+		phases = append(phases, installPhases[done+i])
+	}
+
+	return
+}
+
+// ResumeState is a copy of the state to run with, the runner adds secrets to it
+// which must not end up in the checkpoint
+func (c Checkpoint) ResumeState() map[string]string {
+	state := map[string]string{}
+	for k, v := range c.State {
+		state[k] = v
+	}
+	return state
+}
+
+func labelIndex(cmds []Command, label string) int {
+	for i, cmd := range cmds {
+		if cmd.Message() == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// replayOnResume are the commands whose effect is gone after the disk was closed
+func replayOnResume(cmd Command) bool {
+	c, ok := cmd.(ExecCommand)
+	return ok && (c.Program == "mkdir" || c.Program == "mount" || c.Program == "umount")
+}
+
+// ReopenCommands unmount and close whatever is left of the failed run and open the encrypted partitions again
+func ReopenCommands(conf configuration.Conf, state map[string]string) (cmds []Command) {
+	cmds = append(cmds, ShellCommand{
+		Label: "Unmount /mnt if it's still mounted",
+		Cmd:   "if mountpoint -q /mnt; then umount -R /mnt; fi",
+	})
+
+	if !conf.Disk.Encrypt {
+		return
+	}
+
+	key := LuksPassword(conf.Disk.EncryptionPasswd)
+	if conf.Yubikey {
+		cmds = append(cmds, YubikeyLuksPassCommands(conf.Disk.EncryptionPasswd, conf.YubikeySlot, conf.YubikeySalt)...)
+		key = YubikeyLuksPass()
+	}
+
+	for _, p := range conf.Disk.Partitions {
+		if p.Bootable {
+			continue
+		}
+
+		// Device names can change after a reboot, the UUID of a detached header isn't on the device
+		if uuid := strings.TrimSpace(state[LuksUUIDKey(p)]); uuid != "" && p.LuksHeader == "" {
+			p.Path = "/dev/disk/by-uuid/" + uuid
+		}
+
+		cmds = append(cmds,
+			ShellCommand{
+				Label: fmt.Sprintf("Close %s if it's still open", p.Label),
+				Cmd:   fmt.Sprintf("if [ -e /dev/mapper/%[1]s ]; then cryptsetup close %[1]s; fi", util.ShellQuote(p.Label)),
+			},
+			Cryptsetup("Reopen "+p.Path, "luksOpen", p, &key, p.Label, "--key-file", "-"),
+			WaitForDevice("/dev/mapper/"+p.Label),
+		)
+	}
+
+	return
+}
+
+// ResolveLuksUUIDs store the UUIDs of the encrypted partitions in the state
+func ResolveLuksUUIDs(conf configuration.Conf) (cmds []Command) {
+	if !conf.Disk.Encrypt {
+		return
+	}
+
+	for _, p := range conf.Disk.Partitions {
+		if p.Bootable {
+			continue
+		}
+		cmd := Cryptsetup("Resolve the LUKS UUID of "+p.Path, "luksUUID", p, nil)
+		cmd.OutLabel = LuksUUIDKey(p)
+		cmds = append(cmds, cmd)
+	}
+
+	return
+}
+
+func LuksUUIDKey(p disk.Partition) string {
+	return "LUKS_UUID_" + p.Label
+}
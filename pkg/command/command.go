@@ -1,53 +1,201 @@
 package command
 
 import (
+	"context"
 	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/Meerschwein/nixos-go-up/pkg/events"
 	"github.com/Meerschwein/nixos-go-up/pkg/util"
 )
 
 const (
 	BOOTLABEL = "NIXBOOT"
 	ROOTLABEL = "NIXROOT"
+
+	// KEYFILE unlocks the encrypted partitions in the initrd, same path on the target and in the initrd
+	KEYFILE = "/etc/secrets/initrd/keyfile"
+	// Labels of the steps writing /mnt/etc/nixos, resuming on a tmpfs root looks for them
+	GENERATECONFIG = "Generate default nixos configuration at /mnt"
+	PERSISTCONFIG  = "Persist the nixos configuration"
+	// Outputs pinning the impermanence module, see PinImpermanence
+	IMPERMANENCEREV  StateValue = "IMPERMANENCE_REV"
+	IMPERMANENCEHASH StateValue = "IMPERMANENCE_SHA256"
+	// PERSISTDIR is bind mounted from PERSISTSTORAGE in the impermanence layout
+	PERSISTDIR     = "/persist"
+	PERSISTSTORAGE = "/nix/persist"
+
+	IMPERMANENCEREPO = "https://github.com/nix-community/impermanence"
 )
 
 type Command interface {
 	Message() string
-	Execute(map[string]string) (key string, val string, err error)
+	Execute(context.Context, Executor, map[string]string) (key string, val string, err error)
 	ToShellCommand() string
 }
 
 func DryRun(cmds []Command) {
 	for _, cmd := range cmds {
-		fmt.Printf("--\n%s\n%s\n", cmd.Message(), cmd.ToShellCommand())
+		fmt.Fprintf(util.Out, "--\n%s\n%s\n", cmd.Message(), cmd.ToShellCommand())
 	}
 }
 
-func RunCmds(cmds []Command) {
-	state := make(map[string]string)
-	for _, cmd := range cmds {
-		fmt.Printf("-----\n%s\n", cmd.Message())
-		key, val, err := cmd.Execute(state)
-		if val != "" {
-			fmt.Println(val)
+func RunCmds(cmds []Command, executor Executor) {
+	util.ExitIfErr(ExecuteCmds(cmds, executor))
+}
+
+// ExecuteCmds runs the commands in order and stops at the first failure
+func ExecuteCmds(cmds []Command, executor Executor) error {
+	return Runner{Executor: executor}.Run(context.Background(), cmds, map[string]string{})
+}
+
+type Runner struct {
+	Executor Executor
+	// Done is called after every successful command with its index and the state so far
+	Done func(i int, cmd Command, state map[string]string)
+	// Log records every command with the phase at the same index in Phases
+	Log    *ExecLog
+	Phases []string
+	// Events reports every command to a frontend instead of printing it
+	Events *events.Stream
+}
+
+// Run executes the commands in order starting with the given state and stops at the first failure
+func (r Runner) Run(ctx context.Context, cmds []Command, state map[string]string) error {
+	for i, cmd := range cmds {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+
+		r.started(i, len(cmds), cmd)
+		key, val, err := policyOf(cmd).execute(ctx, cmd, r.Executor, state, func(attempt int, start time.Time, err error) {
+			r.finished(i, len(cmds), cmd, attempt, start, err)
+		})
 		if key != "" {
 			state[key] = val
 		}
-		util.ExitIfErr(err)
+		if err != nil {
+			return err
+		}
+		if r.Done != nil {
+			r.Done(i, cmd, state)
+		}
+	}
+	return nil
+}
+
+func (r Runner) started(i, total int, cmd Command) {
+	if r.Events == nil {
+		fmt.Fprintf(util.Out, "-----\n%s\n", cmd.Message())
+		return
+	}
+	r.Events.Emit(events.Event{Type: events.START, Index: &i, Total: total, Label: cmd.Message(), Phase: r.phase(i)})
+}
+
+// finished is called after every attempt of a command
+func (r Runner) finished(i, total int, cmd Command, attempt int, start time.Time, err error) {
+	end := time.Now()
+	if r.Log != nil {
+		r.Log.Record(cmd, r.phase(i), start, end, err)
+	}
+	if r.Events == nil {
+		return
+	}
+
+	done := i
+	if err == nil {
+		done++
+	}
+	code := ExitCode(err)
+	e := events.Event{
+		Type:     events.FINISH,
+		Index:    &i,
+		Total:    total,
+		Label:    cmd.Message(),
+		Phase:    r.phase(i),
+		Attempt:  attempt,
+		Duration: end.Sub(start).Seconds(),
+		ExitCode: &code,
+		Progress: float64(done) / float64(total),
 	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.Events.Emit(e)
+}
+
+func (r Runner) phase(i int) string {
+	if i < len(r.Phases) {
+		return r.Phases[i]
+	}
+	return ""
 }
 
 func ShellScript(cmds []Command) (script string) {
-	script += "#!/usr/bin/env bash\n\n"
+	script += "#!/usr/bin/env bash\n\nset -eo pipefail\n\n"
+
+	// Keep the tools nixos-go-up was packaged with
+	if dirs := ToolDirs(); len(dirs) > 0 {
+		script += fmt.Sprintf("export PATH=\"%s:$PATH\"\n\n", strings.Join(dirs, ":"))
+	}
+
+	for _, s := range ScriptSecrets(cmds) {
+		script += fmt.Sprintf("%s\n\n", s.ScriptPrompt())
+	}
 
 	for _, c := range cmds {
 		script += fmt.Sprintf(
 			"# %s\n%s\n\n",
 			c.Message(),
-			c.ToShellCommand(),
+			policyOf(c).retryLoop(c.ToShellCommand()),
 		)
 	}
 
 	return
 }
+
+// ScriptSecrets are the secrets a generated script has to ask for,
+// secrets from the state are computed by the script itself
+func ScriptSecrets(cmds []Command) (secrets []Secret) {
+	seen := map[string]bool{}
+	for _, cmd := range cmds {
+		var cmdSecrets []Secret
+		switch c := cmd.(type) {
+		case ShellCommand:
+			cmdSecrets = c.Secrets
+		case FuncCommand:
+			cmdSecrets = c.Secrets
+		case ExecCommand:
+			cmdSecrets = c.allSecrets()
+		}
+
+		for _, s := range cmdSecrets {
+			if !seen[s.Name] && !s.FromState {
+				seen[s.Name] = true
+				secrets = append(secrets, s)
+			}
+		}
+	}
+	return
+}
+
+// ToolDirs are the directories of the tools used in generated scripts
+// which aren't necessarily available on the installation medium
+func ToolDirs() (dirs []string) {
+	seen := map[string]bool{}
+	for _, tool := range []string{"pbkdf2-sha512", "mkpasswd", "sbctl", "ykchalresp"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Dir(path)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return
+}
@@ -3,44 +3,113 @@ package command
 import (
 	"bytes"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+	"github.com/Meerschwein/nixos-go-up/pkg/disk"
 	"github.com/Meerschwein/nixos-go-up/pkg/util"
 )
 
 type CommandGenerator func(configuration.Conf) (configuration.Conf, []Command)
 
-func MakeCommandGenerators(conf configuration.Conf) (gens []CommandGenerator) {
+const (
+	PHASEDISK      = "disk"
+	PHASEMOUNT     = "mount"
+	PHASECONFIGURE = "configure"
+	PHASEINSTALL   = "install"
+	PHASEENROLL    = "enroll"
+	// PHASERESUME reopens the disk of a resumed installation
+	PHASERESUME = "resume"
+)
+
+// Phase groups the generators of one step of the installation
+type Phase struct {
+	Name       string
+	Generators []CommandGenerator
+}
+
+func MakeCommandGenerators(conf configuration.Conf) []CommandGenerator {
+	return Generators(MakePhases(conf))
+}
+
+func MakePhases(conf configuration.Conf) []Phase {
+	return append([]Phase{{Name: PHASEDISK, Generators: DiskGenerators(conf)}}, InstallPhases()...)
+}
+
+// DiskGenerators partition, encrypt and format the disk, an installation
+// can only be resumed once they are done
+func DiskGenerators(conf configuration.Conf) (gens []CommandGenerator) {
 	if conf.IsUEFI() {
 		gens = append(gens, UEFIDiskSetup)
 	} else {
 		gens = append(gens, BIOSDiskSetup)
 	}
 
-	gens = append(gens, Stable(DiskCommands))
+	return append(gens,
+		Stable(YubikeySetupCommands),
+		Stable(PartitionDisk),
+		Stable(WaitForPartitions),
+		Hook(HOOKPOSTPARTITION),
+		Stable(FormatDisk),
+	)
+}
 
-	if conf.Disk.Encrypt {
-		gens = append(gens, CmdsToGen(MountDir("/dev/mapper/"+ROOTLABEL, "/mnt")...))
-	} else {
-		gens = append(gens, CmdsToGen(MountByLabel(ROOTLABEL, "/mnt")...))
+// InstallPhases start by mounting the partitions
+func InstallPhases() []Phase {
+	return []Phase{
+		{Name: PHASEMOUNT, Generators: []CommandGenerator{
+			Stable(MountPartitions),
+			Hook(HOOKPOSTMOUNT),
+		}},
+		{Name: PHASECONFIGURE, Generators: []CommandGenerator{
+			Stable(InstallKeyfile),
+			Stable(SecureBootKeyCommands),
+			WriteNixosConfig,
+		}},
+		{Name: PHASEINSTALL, Generators: []CommandGenerator{
+			CmdsToGen(ShellCommand{
+				Label: "Running nixos-install",
+				Cmd:   "nixos-install --no-root-passwd",
+				// Downloads from the binary cache break on bad networks
+				Policy: Policy{Retries: 3, Backoff: 30 * time.Second, Errors: SUBSTITUTERERRORS},
+			}),
+			Hook(HOOKPOSTINSTALL),
+		}},
+		{Name: PHASEENROLL, Generators: []CommandGenerator{
+			Stable(SecureBootEnrollCommands),
+		}},
 	}
+}
 
-	if conf.IsUEFI() {
-		gens = append(gens, CmdsToGen(MountByLabel(BOOTLABEL, "/mnt/boot")...))
+func Generators(phases []Phase) (gens []CommandGenerator) {
+	for _, phase := range phases {
+		gens = append(gens, phase.Generators...)
 	}
+	return
+}
 
-	gens = append(gens,
-		WriteNixosConfig,
-		CmdsToGen(ShellCommand{
-			Label: "Running nixos-install",
-			Cmd:   "nixos-install --no-root-passwd",
-		}),
-	)
-
+// GeneratePhases also returns the name of the phase of every command
+func GeneratePhases(conf configuration.Conf, phases []Phase) (cmds []Command, phaseOf []string) {
+	_, cmds, phaseOf = generatePhases(conf, phases)
 	return
 }
 
+func generatePhases(conf configuration.Conf, phases []Phase) (configuration.Conf, []Command, []string) {
+	cmds, phaseOf := []Command{}, []string{}
+	for _, phase := range phases {
+		var c []Command
+		conf, c = generate(conf, phase.Generators)
+		cmds = append(cmds, c...)
+		for range c {
+			phaseOf = append(phaseOf, phase.Name)
+		}
+	}
+	return conf, cmds, phaseOf
+}
+
 func CmdsToGen(cmds ...Command) CommandGenerator {
 	return func(conf configuration.Conf) (configuration.Conf, []Command) {
 		return conf, cmds
@@ -54,13 +123,19 @@ func Stable(f func(configuration.Conf) []Command) CommandGenerator {
 }
 
 func GenerateCommands(conf configuration.Conf, generators []CommandGenerator) (cmds []Command) {
-	loopConf := conf
+	_, cmds = generate(conf, generators)
+	return
+}
+
+// generate also returns the configuration after all generators modified it
+func generate(conf configuration.Conf, generators []CommandGenerator) (configuration.Conf, []Command) {
+	cmds := []Command{}
 	for _, gen := range generators {
-		conf, c := gen(loopConf)
-		loopConf = conf
+		var c []Command
+		conf, c = gen(conf)
 		cmds = append(cmds, c...)
 	}
-	return
+	return conf, cmds
 }
 
 func GenerateCustomNixosConfig(conf configuration.Conf) string {
@@ -70,7 +145,8 @@ func GenerateCustomNixosConfig(conf configuration.Conf) string {
 		Desktopmanager: configuration.NixExpression(conf.DesktopEnviroment),
 		KeyboardLayout: conf.KeyboardLayout,
 		Username:       conf.Username,
-		PasswordHash:   util.MkPasswd(conf.Password),
+		// The hash is filled in by WriteNixosConfig so it doesn't end up in scripts
+		PasswordHash: UserPasswordHash("").Placeholder(),
 	}
 
 	inters := ""
@@ -79,13 +155,50 @@ func GenerateCustomNixosConfig(conf configuration.Conf) string {
 	}
 	replacement.NetworkingInterfaces = inters
 
+	replacement.FileSystems = FileSystemsNixExpression(conf.Disk)
+	replacement.Discard = DiscardNixExpression(conf.Disk)
+	replacement.Keyfile = KeyfileNixExpression(conf)
+	replacement.DetachedHeader = DetachedHeaderNixExpression(conf.Disk)
+	replacement.Cryptenroll = CryptenrollNixExpression(conf)
+
+	imports := []string{}
+
 	if conf.IsUEFI() {
 		replacement.Bootloader = "boot.loader.systemd-boot.enable = true;"
 		replacement.GrubDevice = "nodev"
+		if conf.EncryptedBoot() {
+			// systemd-boot only reads the ESP, GRUB can unlock /boot on the root
+			replacement.Bootloader = "boot.loader.grub.enable = true;\n  boot.loader.grub.efiSupport = true;\n  " +
+				fmt.Sprintf("boot.loader.efi.efiSysMountPoint = %q;", conf.BootMountpoint())
+		}
+		if conf.SecureBoot {
+			replacement.Bootloader = SecureBootNixExpression()
+			replacement.Packages = "sbctl"
+			imports = append(imports, fmt.Sprintf("(builtins.getFlake %q).nixosModules.lanzaboote", LANZABOOTE))
+		}
 	} else {
 		replacement.Bootloader = "boot.loader.grub.enable = true;\n  boot.loader.grub.version = 2;"
 		replacement.GrubDevice = "/dev/" + conf.Disk.Name
+		if conf.HasBootPartition() {
+			// GRUB only reads the kernels from /boot, the store is encrypted or on another partition
+			replacement.Bootloader += "\n  boot.loader.grub.copyKernels = true;"
+		}
 	}
+	if conf.EncryptedBoot() {
+		replacement.Bootloader += "\n  boot.loader.grub.enableCryptodisk = true;"
+	}
+
+	if conf.IsImpermanent() {
+		imports = append(imports, fmt.Sprintf(
+			`"${builtins.fetchTarball { url = "%s/archive/%s.tar.gz"; sha256 = "%s"; }}/nixos.nix"`,
+			IMPERMANENCEREPO,
+			IMPERMANENCEREV.Placeholder(),
+			IMPERMANENCEHASH.Placeholder(),
+		))
+		replacement.Impermanence = ImpermanenceNixExpression(conf)
+	}
+
+	replacement.Imports = strings.Join(imports, "\n    ")
 
 	t := template.Must(template.New("NixOS configuration.nix").Parse(NixOSConfiguration()))
 	var data bytes.Buffer
@@ -96,14 +209,210 @@ func GenerateCustomNixosConfig(conf configuration.Conf) string {
 	return data.String()
 }
 
+func FileSystemsNixExpression(d disk.Disk) (config string) {
+	for _, p := range d.MountedPartitions() {
+		if len(p.MountOptions) == 0 {
+			continue
+		}
+
+		config += fmt.Sprintf("fileSystems.%q.options = [ %s ];\n  ", p.Mountpoint, nixStrings(p.MountOptions, " "))
+	}
+	return
+}
+
+func DiscardNixExpression(d disk.Disk) (config string) {
+	if !d.Discard {
+		return
+	}
+
+	config = "services.fstrim.enable = true;\n  "
+
+	if d.Encrypt {
+		for _, p := range d.Partitions {
+			if p.Bootable {
+				continue
+			}
+			// Attribute paths, the other options of the device are set elsewhere
+			config += fmt.Sprintf("boot.initrd.luks.devices.%[1]q.allowDiscards = true;\n  "+
+				"boot.initrd.luks.devices.%[1]q.bypassWorkqueues = true;\n  ", p.Label)
+		}
+	}
+
+	return
+}
+
+func KeyfileNixExpression(conf configuration.Conf) (config string) {
+	if !conf.EncryptedBoot() {
+		return
+	}
+
+	// The initrd is on the encrypted /boot, the key is as safe as the disk itself
+	config = fmt.Sprintf("boot.initrd.secrets = {\n    %q = %q;\n  };\n  ", KEYFILE, KEYFILE)
+
+	for _, p := range conf.Disk.Partitions {
+		if p.Bootable {
+			continue
+		}
+		config += fmt.Sprintf("boot.initrd.luks.devices.%q.keyFile = %q;\n  ", p.Label, KEYFILE)
+	}
+
+	return
+}
+
+func DetachedHeaderNixExpression(d disk.Disk) (config string) {
+	if !d.Encrypt {
+		return
+	}
+
+	for _, p := range d.Partitions {
+		if p.Bootable || p.LuksHeader == "" {
+			continue
+		}
+		// Without a header nixos-generate-config can't find the UUID of the device,
+		// the PARTUUID is stable unlike the kernel name
+		config += fmt.Sprintf("boot.initrd.luks.devices.%[1]q.device = lib.mkForce \"/dev/disk/by-partuuid/%[2]s\";\n  "+
+			"boot.initrd.luks.devices.%[1]q.header = %[3]q;\n  ", p.Label, PartUUID(p).Placeholder(), p.LuksHeader)
+	}
+
+	return
+}
+
+func CryptenrollNixExpression(conf configuration.Conf) (config string) {
+	opts := []string{}
+	if conf.TPM2 {
+		opts = append(opts, "tpm2-device=auto")
+	}
+	if conf.FIDO2Keys > 0 {
+		opts = append(opts, "fido2-device=auto")
+	}
+
+	if !conf.Disk.Encrypt || len(opts) == 0 {
+		return
+	}
+
+	// Only the systemd initrd can unlock tokens enrolled with systemd-cryptenroll
+	config = "boot.initrd.systemd.enable = true;\n  "
+
+	for _, p := range conf.Disk.Partitions {
+		if p.Bootable {
+			continue
+		}
+		config += fmt.Sprintf("boot.initrd.luks.devices.%q.crypttabExtraOpts = [ %s ];\n  ", p.Label, nixStrings(opts, " "))
+	}
+
+	return
+}
+
+func ImpermanenceNixExpression(conf configuration.Conf) string {
+	return fmt.Sprintf(`fileSystems."/" = {
+    device = "none";
+    fsType = "tmpfs";
+    options = [ %s ];
+  };
+  fileSystems.%q.neededForBoot = true;
+
+  environment.persistence.%q = {
+    hideMounts = true;
+    directories = [
+      %s
+    ];
+    files = [
+      %s
+    ];
+  };`,
+		nixStrings(conf.MountOptions["/"], " "),
+		PERSISTDIR,
+		PERSISTDIR,
+		nixStrings(conf.PersistDirectories(), "\n      "),
+		nixStrings(configuration.PersistFiles(), "\n      "),
+	)
+}
+
+func nixStrings(ss []string, sep string) string {
+	quoted := []string{}
+	for _, s := range ss {
+		quoted = append(quoted, fmt.Sprintf("%q", s))
+	}
+	return strings.Join(quoted, sep)
+}
+
+func YubikeyStorageFsType(p disk.Partition) string {
+	if p.Format == disk.Fat32 {
+		return "vfat"
+	}
+	return string(p.Format)
+}
+
+// PinImpermanence resolves the current revision of the impermanence module and
+// its hash, the configuration keeps using them until they're changed by hand
+func PinImpermanence(conf configuration.Conf) (cmds []Command) {
+	if !conf.IsImpermanent() {
+		return
+	}
+
+	network := Policy{Retries: 3, Backoff: 5 * time.Second}
+	return []Command{
+		ShellCommand{
+			Label:    "Resolve the current revision of the impermanence module",
+			Cmd:      fmt.Sprintf(`curl -fsSL -H "Accept: application/vnd.github.sha" https://api.github.com/repos/%s/commits/master`, strings.TrimPrefix(IMPERMANENCEREPO, "https://github.com/")),
+			OutLabel: string(IMPERMANENCEREV),
+			Policy:   network,
+		},
+		ShellCommand{
+			Label:    "Hash the pinned impermanence module",
+			Cmd:      fmt.Sprintf("nix-prefetch-url --unpack %s/archive/%s.tar.gz", IMPERMANENCEREPO, IMPERMANENCEREV.Ref()),
+			OutLabel: string(IMPERMANENCEHASH),
+			Policy:   network,
+		},
+	}
+}
+
+// PartUUID of the partition, see ResolvePartUUIDs
+func PartUUID(p disk.Partition) StateValue {
+	return StateValue("PARTUUID_" + p.Label)
+}
+
+// ResolvePartUUIDs of the partitions with a detached header, see DetachedHeaderNixExpression
+func ResolvePartUUIDs(conf configuration.Conf) (cmds []Command, values []StateValue) {
+	if !conf.Disk.Encrypt {
+		return
+	}
+
+	for _, p := range conf.Disk.Partitions {
+		if p.Bootable || p.LuksHeader == "" {
+			continue
+		}
+		cmds = append(cmds, ShellCommand{
+			Label:    "Resolve the PARTUUID of " + p.Path,
+			Cmd:      fmt.Sprintf("lsblk -dno PARTUUID %s | grep .", p.Path),
+			OutLabel: string(PartUUID(p)),
+		})
+		values = append(values, PartUUID(p))
+	}
+	return
+}
+
 func WriteNixosConfig(conf configuration.Conf) (_ configuration.Conf, cmds []Command) {
+	cmds = append(cmds, PinImpermanence(conf)...)
+	partUUIDs, values := ResolvePartUUIDs(conf)
+	cmds = append(cmds, partUUIDs...)
 	cmds = append(cmds, ShellCommand{
-		Label: "Generate default nixos configuration at /mnt",
+		Label: GENERATECONFIG,
 		Cmd:   "nixos-generate-config --root /mnt",
 	})
 
+	if conf.IsImpermanent() {
+		values = append(values, IMPERMANENCEREV, IMPERMANENCEHASH)
+	}
+
 	config := GenerateCustomNixosConfig(conf)
-	cmds = append(cmds, WriteToFile("Generate custom nixos configuration file", config, "/mnt/etc/nixos/configuration.nix"))
+	cmds = append(cmds, WriteSecretsToFile(
+		"Generate custom nixos configuration file",
+		config,
+		"/mnt/etc/nixos/configuration.nix",
+		values,
+		UserPasswordHash(util.MkPasswd(conf.Password)),
+	))
 
 	if conf.Yubikey {
 		cmds = append(cmds, AppendToFile(
@@ -122,6 +431,7 @@ func WriteNixosConfig(conf configuration.Conf) (_ configuration.Conf, cmds []Com
         twoFactor = %v;
         storage = {
           device = "%s";
+          fsType = "%s";
         };
       };
     };
@@ -132,10 +442,34 @@ func WriteNixosConfig(conf configuration.Conf) (_ configuration.Conf, cmds []Com
 				conf.YubikeySlot,
 				conf.Disk.EncryptionPasswd != "",
 				conf.Disk.GetBootPartition().Path,
+				YubikeyStorageFsType(conf.Disk.GetBootPartition()),
 			),
 			"/mnt/etc/nixos/hardware-configuration.nix",
 		))
 	}
 
+	// Only after everything is written to /mnt/etc/nixos
+	if conf.IsImpermanent() {
+		persistedConfig := filepath.Join("/mnt", PERSISTSTORAGE, "etc")
+		cmds = append(cmds,
+			CreateDir(persistedConfig),
+			ShellCommand{
+				Label: PERSISTCONFIG,
+				Cmd:   fmt.Sprintf("cp -a /mnt/etc/nixos %s", persistedConfig),
+			},
+		)
+	}
+
 	return conf, cmds
 }
+
+// RestoreNixosConfig copies the persisted configuration back onto a new tmpfs root
+func RestoreNixosConfig() []Command {
+	return []Command{
+		CreateDir("/mnt/etc"),
+		ShellCommand{
+			Label: "Restore the nixos configuration from " + filepath.Join("/mnt", PERSISTSTORAGE, "etc/nixos"),
+			Cmd:   fmt.Sprintf("cp -a %s /mnt/etc", filepath.Join("/mnt", PERSISTSTORAGE, "etc/nixos")),
+		},
+	}
+}
@@ -1,10 +1,23 @@
 package command_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Meerschwein/nixos-go-up/pkg/command"
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
 	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+	"github.com/Meerschwein/nixos-go-up/pkg/events"
 	"github.com/Meerschwein/nixos-go-up/test/generators"
 	"github.com/stretchr/testify/require"
 	"pgregory.net/rapid"
@@ -39,3 +52,397 @@ func TestDisk_MakeFilesystemCommand_Properties(t *testing.T) {
 		require.NotEqual(t, cmds, cmds2, "Different Formats got the same commands")
 	})
 }
+
+func TestMountPartitions_Options_Properties(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		conf := generators.Configuration().Draw(t, "Configuration").(configuration.Conf)
+		options := rapid.SliceOfN(rapid.StringMatching(`[a-z]+`), 1, 3).Draw(t, "Options").([]string)
+		conf.MountOptions = map[string][]string{"/": options}
+
+		conf, _ = command.UEFIDiskSetup(conf)
+		cmds := command.MountPartitions(conf)
+
+		require.NotEmpty(t, cmds, "Didn't get any commands")
+		require.Contains(t, cmds[1].ToShellCommand(), "-o "+strings.Join(options, ","), "Root mounted without its options")
+		require.Contains(t, command.FileSystemsNixExpression(conf.Disk), `fileSystems."/".options`, "Options missing in configuration")
+	})
+}
+
+func TestGenerateCommands_InitrdKeyOnlyOnEncryptedBoot_Properties(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		conf := generators.Configuration().Draw(t, "Configuration").(configuration.Conf)
+		conf.Disk.Encrypt = true
+
+		script := command.ShellScript(command.GenerateCommands(conf, command.MakeCommandGenerators(conf)))
+
+		// A key in an initrd on an unencrypted /boot would unlock the disk for anyone
+		require.Equal(t, conf.EncryptedBoot(), strings.Contains(script, "boot.initrd.secrets"), "Initrd secret without encrypted /boot")
+		require.Equal(t, conf.EncryptedBoot(), strings.Contains(script, "keyFile"), "Initrd keyfile without encrypted /boot")
+		if conf.EncryptedBoot() {
+			require.NotContains(t, script, "mount -L "+command.BOOTLABEL+" /mnt/boot\n", "Unencrypted partition mounted at /boot")
+			require.Contains(t, script, "boot.loader.grub.enableCryptodisk = true;", "GRUB can't unlock /boot")
+			require.NotContains(t, script, "--pbkdf argon2", "GRUB can't unlock argon2 keyslots")
+		}
+	})
+}
+
+func TestGenerateCommands_NoSecrets_Properties(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		conf := generators.Configuration().Draw(t, "Configuration").(configuration.Conf)
+		conf.Disk.Encrypt = true
+		conf.Disk.EncryptionPasswd = rapid.StringMatching(`[a-zA-Z0-9]{16}`).Draw(t, "EncryptionPasswd").(string)
+		conf.Disk.RecoveryPasswd = rapid.StringMatching(`[a-zA-Z0-9]{16}`).Draw(t, "RecoveryPasswd").(string)
+
+		cmds := command.GenerateCommands(conf, command.MakeCommandGenerators(conf))
+
+		for _, cmd := range cmds {
+			for _, rendered := range []string{cmd.Message(), cmd.ToShellCommand(), fmt.Sprintf("%v %+v %#v", cmd, cmd, cmd)} {
+				require.NotContains(t, rendered, conf.Disk.EncryptionPasswd, "Encryption password leaked")
+				require.NotContains(t, rendered, conf.Disk.RecoveryPasswd, "Recovery passphrase leaked")
+			}
+		}
+
+		script := command.ShellScript(cmds)
+		require.NotContains(t, script, conf.Disk.EncryptionPasswd, "Encryption password in script")
+		require.Contains(t, script, "read -r -s -p \"Encryption password: \" LUKS_PASSWORD", "Script doesn't ask for the encryption password")
+	})
+}
+
+func TestExecCommand_Args_Properties(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		to := rapid.StringMatching(`/[a-z $;'"*]+`).Draw(t, "Mountpoint").(string)
+		label := rapid.StringMatching(`[A-Z $;'"*]+`).Draw(t, "Label").(string)
+
+		cmds := command.MountByLabel(label, to)
+		executor := &command.RecordingExecutor{}
+		require.NoError(t, command.ExecuteCmds(cmds, executor))
+
+		mount := executor.Runs[1]
+		require.Equal(t, []string{"mount", "-L", label, to}, mount.Argv, "Arguments aren't passed verbatim")
+
+		out, err := exec.Command("bash", "-c", "printf '%s\\n' "+strings.TrimPrefix(mount.Cmd, "mount ")).Output()
+		require.NoError(t, err)
+		require.Equal(t, "-L\n"+label+"\n"+to+"\n", string(out), "Shell rendering doesn't quote the arguments")
+	})
+}
+
+func TestShellCommand_State_Properties(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		name := rapid.StringMatching(`[A-Z][A-Z_]{0,8}`).Draw(t, "Name").(string)
+		short := rapid.StringMatching(`[a-z0-9]{1,8}`).Draw(t, "Short").(string)
+		long := rapid.StringMatching(`[a-z0-9]{1,8}`).Draw(t, "Long").(string)
+		state := map[string]string{name: short + "\n", name + "_2": long}
+
+		executor := &command.RecordingExecutor{}
+		cmd := command.ShellCommand{Label: "Substitute", Cmd: fmt.Sprintf("echo $%[1]s $%[1]s_2 ${%[1]s}x $%[1]sX", name)}
+		_, _, err := cmd.Execute(context.Background(), executor, state)
+		require.NoError(t, err)
+
+		want := fmt.Sprintf("echo %s %s %sx $%sX", short, long, short, name)
+		require.Equal(t, want, executor.Runs[0].Cmd, "Not substituted by whole names")
+	})
+}
+
+func TestExecLog_Entries(t *testing.T) {
+	var out bytes.Buffer
+	log := command.NewExecLog(&out)
+
+	executor := command.BashExecutor{Stdout: io.Discard, Stderr: io.Discard}
+	runner := command.Runner{Executor: executor, Log: log, Phases: []string{command.PHASEDISK, command.PHASEMOUNT}}
+
+	passwd := command.LuksPassword("hunter2")
+	cmds := []command.Command{
+		command.ShellCommand{Label: "Use the secret", Cmd: fmt.Sprintf("test -n %s", passwd.Ref()), Secrets: []command.Secret{passwd}},
+		command.ShellCommand{Label: "Fail", Cmd: "echo oops >&2; exit 3"},
+		command.ShellCommand{Label: "Never run", Cmd: "true"},
+	}
+	log.Begin("resume", time.Now())
+	require.Error(t, runner.Run(context.Background(), cmds, map[string]string{}))
+
+	require.NotContains(t, out.String(), "hunter2", "Log contains a secret")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3, "Not a header and one line per executed command")
+
+	run := command.LogRun{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &run))
+	require.Equal(t, "resume", run.Run, "Run doesn't start with its header")
+
+	entries := []command.LogEntry{}
+	for _, line := range lines[1:] {
+		entry := command.LogEntry{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+
+	require.Equal(t, 0, entries[0].ExitCode)
+	require.Equal(t, command.PHASEDISK, entries[0].Phase)
+	require.Equal(t, 3, entries[1].ExitCode)
+	require.Equal(t, "oops\n", entries[1].Stderr)
+	require.Equal(t, command.PHASEMOUNT, entries[1].Phase)
+	require.Contains(t, log.Summary(), command.PHASEMOUNT)
+}
+
+func TestTeardown_KeepsGoing(t *testing.T) {
+	executor := &command.RecordingExecutor{Fail: map[string]error{"findmnt": fmt.Errorf("target is busy")}}
+	runner := command.Runner{Executor: executor}
+
+	err := command.Teardown(context.Background(), runner, "sda")
+	require.Error(t, err, "Failure isn't reported")
+	require.Len(t, executor.Runs, len(command.TeardownCommands("sda")), "Teardown stopped at the first failure")
+	require.Contains(t, executor.Record(), "cryptsetup close", "LUKS mappings aren't closed")
+}
+
+func TestRunner_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	executor := &command.RecordingExecutor{}
+	err := command.Runner{Executor: executor}.Run(ctx, command.TeardownCommands(""), map[string]string{})
+
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, executor.Runs, "Commands ran after the cancellation")
+}
+
+func TestHookCommands_Run(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := "#!/bin/sh\necho \"$0 $NIXOS_GO_UP_HOOK $NIXOS_GO_UP_HOSTNAME\" >> " + out + "\n"
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "post-mount"), []byte(script), 0o755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "post-mount.d"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "post-mount.d", "20-b"), []byte(script), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "post-mount.d", "10-a"), []byte(script), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "post-mount.d", "README"), []byte("not a hook"), 0o644))
+
+	conf := configuration.Conf{Hostname: "host", Password: "user-passw0rd", HooksDir: dir}
+	cmds := command.HookCommands(conf, command.HOOKPOSTMOUNT)
+	require.Len(t, cmds, 3, "Non executables are run")
+	require.Empty(t, command.HookCommands(conf, command.HOOKPOSTINSTALL))
+	for _, cmd := range cmds {
+		require.NotContains(t, cmd.ToShellCommand(), "user-passw0rd", "Secrets are exposed to hooks")
+	}
+
+	executor := command.BashExecutor{Stdin: os.Stdin, Stdout: io.Discard, Stderr: io.Discard}
+	require.NoError(t, command.Runner{Executor: executor}.Run(context.Background(), cmds, map[string]string{}))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, strings.Join([]string{
+		filepath.Join(dir, "post-mount") + " post-mount host",
+		filepath.Join(dir, "post-mount.d", "10-a") + " post-mount host",
+		filepath.Join(dir, "post-mount.d", "20-b") + " post-mount host",
+	}, "\n")+"\n", string(data))
+}
+
+func TestPolicy_Retries(t *testing.T) {
+	dir := t.TempDir()
+	flaky := func(policy command.Policy) command.Command {
+		return command.ShellCommand{
+			Label:  "Flaky",
+			Cmd:    fmt.Sprintf(`echo >> %[1]s/count; [ "$(wc -l < %[1]s/count)" -ge 3 ] || { echo "device busy" >&2; (exit 2); }`, dir),
+			Policy: policy,
+		}
+	}
+	run := func(cmd command.Command) (*command.ExecLog, error) {
+		os.Remove(filepath.Join(dir, "count"))
+		log := command.NewExecLog(nil)
+		executor := command.BashExecutor{Stdin: os.Stdin, Stdout: io.Discard, Stderr: io.Discard}
+		err := command.Runner{Executor: executor, Log: log}.Run(context.Background(), []command.Command{cmd}, map[string]string{})
+		return log, err
+	}
+
+	log, err := run(flaky(command.Policy{Retries: 2, Backoff: time.Millisecond, Errors: []string{"busy"}}))
+	require.NoError(t, err)
+	require.Len(t, log.Entries, 3, "Every attempt is logged")
+
+	log, err = run(flaky(command.Policy{Retries: 2, Backoff: time.Millisecond, ExitCodes: []int{1}}))
+	require.Error(t, err)
+	require.Len(t, log.Entries, 1, "A failure which isn't retryable is retried")
+
+	script := command.ShellScript([]command.Command{flaky(command.Policy{Retries: 2, ExitCodes: []int{2}})})
+	os.Remove(filepath.Join(dir, "count"))
+	require.NoError(t, exec.Command("bash", "-c", script).Run(), "The script doesn't retry")
+
+	missing := filepath.Join(dir, "missing")
+	_, err = run(command.ExecCommand{Label: "Wait", Program: "test", Args: []string{"-b", missing}, Policy: command.Policy{Retries: 2, Backoff: time.Millisecond, GiveUp: missing + " didn't appear"}})
+	require.EqualError(t, err, missing+" didn't appear within 3ms: exit status 1", "The last error doesn't say what was waited for")
+
+	_, err = run(command.ExecCommand{Label: "Hang", Program: "sleep", Args: []string{"5"}, Policy: command.Policy{Timeout: 50 * time.Millisecond}})
+	var timeout *command.TimeoutError
+	require.ErrorAs(t, err, &timeout)
+
+	// The children of bash hold on to the output
+	start := time.Now()
+	_, err = run(command.ShellCommand{Label: "Hang in a child", Cmd: "sleep 4; true", Policy: command.Policy{Timeout: 200 * time.Millisecond}})
+	require.ErrorAs(t, err, &timeout)
+	require.Less(t, time.Since(start), 2*time.Second, "Children of the command weren't killed")
+
+	_, err = run(command.ShellCommand{Label: "Interrupted", Cmd: "kill -INT $$", Policy: command.Policy{Retries: 2, Backoff: time.Millisecond}})
+	require.Error(t, err)
+	require.False(t, command.Policy{Retries: 2}.Retryable(err), "Ctrl-C is retried")
+}
+
+func TestRunner_Events(t *testing.T) {
+	out := &bytes.Buffer{}
+	stream := events.NewStream(out, strings.NewReader(""))
+	executor := &command.RecordingExecutor{Fail: map[string]error{"umount": fmt.Errorf("target is busy")}}
+	cmds := []command.Command{command.CreateDir("/mnt"), command.Unmount("/mnt")}
+
+	err := command.Runner{Executor: executor, Events: stream}.Run(context.Background(), cmds, map[string]string{})
+	require.Error(t, err)
+
+	types := []string{}
+	finished := []events.Event{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e events.Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		types = append(types, e.Type)
+		if e.Type == events.FINISH {
+			finished = append(finished, e)
+		}
+	}
+
+	require.Equal(t, []string{events.START, events.FINISH, events.START, events.FINISH}, types)
+	require.Equal(t, 0.5, finished[0].Progress)
+	require.Empty(t, finished[0].Error)
+	require.Equal(t, 0.5, finished[1].Progress, "A failed command is counted as done")
+	require.Equal(t, "target is busy", finished[1].Error)
+}
+
+func TestPromptCommand_Events(t *testing.T) {
+	cmds := command.EnrollFIDO2(disk.Partition{Path: "/dev/sda2"}, "passwd", 1)[:1]
+	run := func(answers string) (string, error) {
+		out := &bytes.Buffer{}
+		stream := events.NewStream(out, strings.NewReader(answers))
+		executor := command.EventExecutor{BashExecutor: command.BashExecutor{Stdout: io.Discard, Stderr: io.Discard}, Events: stream}
+		err := command.Runner{Executor: executor}.Run(context.Background(), cmds, map[string]string{})
+		return out.String(), err
+	}
+
+	out, err := run(`{"id": 1, "confirm": true}` + "\n")
+	require.NoError(t, err, "Confirmed prompt failed")
+	var prompt events.Event
+	require.NoError(t, json.Unmarshal([]byte(out), &prompt))
+	require.Equal(t, events.PROMPT, prompt.Type)
+	require.Equal(t, events.CONFIRM, prompt.Kind)
+	require.Contains(t, prompt.Label, "Plug in FIDO2 key 1")
+
+	_, err = run(`{"id": 1, "cancel": true}` + "\n")
+	require.Error(t, err, "Cancelled prompt succeeded")
+
+	step, err := command.NewStep(cmds[0])
+	require.NoError(t, err)
+	restored, err := step.Command()
+	require.NoError(t, err)
+	require.Equal(t, cmds[0], restored, "Prompt doesn't survive a plan")
+}
+
+func TestSecureBoot_NixConfig(t *testing.T) {
+	conf := configuration.Conf{Firmware: configuration.UEFI, SecureBoot: true, DesktopEnviroment: configuration.NONE, Disk: disk.Disk{Name: "sda"}}
+	config := command.GenerateCustomNixosConfig(conf)
+
+	require.Equal(t, 1, strings.Count(config, "environment.systemPackages"), "Packages are defined twice")
+	require.Contains(t, config, "    sbctl\n", "sbctl isn't installed")
+}
+
+func TestSecureBoot_TPM2PCRs_Properties(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		conf := generators.Configuration().Draw(t, "Configuration").(configuration.Conf)
+		conf.Disk.Encrypt = true
+		conf.TPM2 = true
+		conf.TPM2Device = "auto"
+		conf.TPM2PCRs = strings.Join(rapid.SliceOfN(rapid.SampledFrom([]string{"0", "2", "4", "7"}), 1, 4).Draw(t, "PCRs").([]string), "+")
+		conf.SecureBoot = rapid.Bool().Draw(t, "SecureBoot").(bool)
+
+		if _, err := conf.EnrolledTPM2PCRs(); err != nil {
+			require.True(t, conf.SecureBoot, "Selected PCRs rejected without Secure Boot")
+			require.Regexp(t, `^7(\+7)*$`, conf.TPM2PCRs, "Rejected although a PCR besides 7 is left")
+			return
+		}
+
+		conf, _ = command.UEFIDiskSetup(conf)
+		enrolled := ""
+		for _, cmd := range command.FormattingCommands(conf) {
+			if strings.Contains(cmd.ToShellCommand(), "--tpm2-pcrs=") {
+				enrolled = cmd.ToShellCommand()
+			}
+		}
+
+		require.NotEmpty(t, enrolled, "TPM2 key isn't enrolled")
+		if conf.SecureBoot {
+			require.NotRegexp(t, `--tpm2-pcrs=([0-9]+\+)*7\b`, enrolled, "Bound to PCR 7 which changes with the Secure Boot keys")
+		} else {
+			require.Contains(t, enrolled, "--tpm2-pcrs="+conf.TPM2PCRs, "Selected PCRs changed without Secure Boot")
+		}
+	})
+}
+
+func TestSecureBootNotes_NoFakeSteps(t *testing.T) {
+	conf := configuration.Conf{Firmware: configuration.UEFI, SecureBoot: true, TPM2: true, TPM2PCRs: "0+7"}
+	conf.Disk.Encrypt = true
+
+	for _, cmd := range command.SecureBootEnrollCommands(conf) {
+		require.NotEqual(t, "true", cmd.ToShellCommand(), "Note shown as a step: %s", cmd.Message())
+	}
+
+	notes := command.SecureBootNotes(conf)
+	require.Len(t, notes, 2, "Missing notes")
+	require.Contains(t, notes[0], "--tpm2-pcrs=0+7", "TPM2 key isn't rebound to the selected PCRs")
+	require.Contains(t, notes[1], "sbctl", "Keys aren't enrolled later")
+}
+
+func TestProgramYubikey_SecretOnStdin(t *testing.T) {
+	secret := "00112233445566778899aabbccddeeff00112233"
+
+	executor := &command.RecordingExecutor{}
+	require.NoError(t, command.ExecuteCmds([]command.Command{command.ProgramYubikey(2, secret)}, executor))
+
+	run := executor.Runs[0]
+	require.NotContains(t, strings.Join(run.Argv, " "), secret, "Secret is in the arguments")
+	require.Contains(t, run.Argv, "-a", "ykpersonalize doesn't ask for the secret")
+	require.NotNil(t, run.Stdin, "Secret isn't piped in")
+	require.Equal(t, secret, run.Stdin.Value)
+}
+
+func TestEscrowRecoveryPassphrase_Path(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "usb dir")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+
+	conf := configuration.Conf{Hostname: "nixos", RecoveryEscrow: filepath.Join(dir, "escrow $(touch pwned).txt")}
+	conf.Disk.Name = "sda"
+	conf.Disk.Encrypt = true
+	conf.Disk.RecoveryPasswd = "correct horse battery staple"
+
+	cmds := command.EscrowRecoveryPassphrase(conf)
+	runner := command.Runner{Executor: command.BashExecutor{Stdout: io.Discard, Stderr: io.Discard}}
+	require.NoError(t, runner.Run(context.Background(), cmds[:1], map[string]string{}))
+
+	escrow, err := os.ReadFile(conf.RecoveryEscrow)
+	require.NoError(t, err)
+	require.Contains(t, string(escrow), conf.Disk.RecoveryPasswd, "Passphrase isn't escrowed")
+	require.NoFileExists(t, "pwned", "Path is evaluated by the shell")
+}
+
+func TestDiskSetup_RootSize_Properties(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		conf := generators.Configuration().Draw(t, "Configuration").(configuration.Conf)
+		conf.Firmware = rapid.SampledFrom([]configuration.Firmware{configuration.UEFI, configuration.BIOS}).Draw(t, "Firmware").(configuration.Firmware)
+		conf.RootSizeGB = rapid.IntRange(0, 64).Draw(t, "RootSizeGB").(int)
+
+		setup := command.UEFIDiskSetup
+		if !conf.IsUEFI() {
+			setup = command.BIOSDiskSetup
+		}
+		conf, _ = setup(conf)
+		root := conf.Disk.GetRootPartition()
+
+		if conf.RootSizeGB == 0 {
+			require.Equal(t, "100%", root.To, "Root partition doesn't fill the disk")
+			return
+		}
+		start, err := strconv.Atoi(strings.TrimSuffix(root.From, "MiB"))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%dMiB", start+conf.RootSizeGB*1024), root.To, "Root partition has the wrong size")
+	})
+}
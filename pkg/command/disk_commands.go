@@ -1,10 +1,12 @@
 package command
 
 import (
-	"crypto/rand"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
 	"github.com/Meerschwein/nixos-go-up/pkg/disk"
@@ -13,11 +15,10 @@ import (
 )
 
 const (
+	// Derivation of the LUKS passphrase from the Yubikey response
 	SALT_LENGTH = 16
 	KEYLENGTH   = 512
 	ITERATIONS  = 1000000
-	CIPHER      = "aes-xts-plain64"
-	HASH        = "sha512"
 )
 
 func PartitioningCommands(d disk.Disk, firmware configuration.Firmware) (cmds []Command) {
@@ -31,39 +32,53 @@ func PartitioningCommands(d disk.Disk, firmware configuration.Firmware) (cmds []
 			partType = "ESP"
 		}
 
-		fsType := ""
+		args := []string{"mkpart", partType}
 		if p.Format == disk.Fat32 {
-			fsType = "fat32"
+			args = append(args, "fat32")
 		}
 
-		cmds = append(cmds, ShellCommand{
-			Label: fmt.Sprintf("Create partition %d on %s from %s to %s", p.Number, d.Name, p.From, p.To),
-			Cmd: fmt.Sprintf("parted -s /dev/%s -- mkpart %s %s %s %s",
-				d.Name,
-				partType,
-				fsType,
-				p.From,
-				p.To,
-			),
-		})
+		cmds = append(cmds, Parted(
+			fmt.Sprintf("Create partition %d on %s from %s to %s", p.Number, d.Name, p.From, p.To),
+			d,
+			append(args, p.From, p.To)...,
+		))
 
 		if p.Bootable {
-			cmds = append(cmds, ShellCommand{
-				Label: fmt.Sprintf("Set partition %d bootable", p.Number),
-				Cmd:   fmt.Sprintf("parted -s /dev/%s -- set %d esp on", d.Name, p.Number),
-			})
+			flag := "boot"
+			if firmware == configuration.UEFI {
+				flag = "esp"
+			}
+
+			cmds = append(cmds, Parted(
+				fmt.Sprintf("Set partition %d bootable", p.Number),
+				d,
+				"set", strconv.Itoa(p.Number), flag, "on",
+			))
 		}
 	}
 	return
 }
 
 func FormattingCommands(conf configuration.Conf) (cmds []Command) {
+	conf.Disk.LUKS = conf.LuksParams()
+
 	for _, p := range conf.Disk.Partitions {
 		if conf.Disk.Encrypt && !p.Bootable {
 			if conf.Yubikey {
-				cmds = append(cmds, FormatAndEncryptPartitionWithYubikey(p, conf.Disk.EncryptionPasswd, conf.YubikeySlot)...)
+				cmds = append(cmds, FormatAndEncryptPartitionWithYubikey(p, conf.Disk.EncryptionPasswd, conf.Disk.LUKS, conf.YubikeySlot, conf.YubikeySalt)...)
 			} else {
-				cmds = append(cmds, FormatAndEncryptPartition(p, conf.Disk.EncryptionPasswd)...)
+				cmds = append(cmds, FormatAndEncryptPartition(p, conf.Disk.EncryptionPasswd, conf.Disk.LUKS)...)
+			}
+			if conf.TPM2 {
+				pcrs, err := conf.EnrolledTPM2PCRs()
+				util.ExitIfErr(err)
+				cmds = append(cmds, EnrollTPM2(p, conf.Disk.EncryptionPasswd, conf.TPM2Device, pcrs))
+			}
+			for key := 1; key <= conf.FIDO2Keys; key++ {
+				cmds = append(cmds, EnrollFIDO2(p, conf.Disk.EncryptionPasswd, key)...)
+			}
+			if conf.Disk.RecoveryPasswd != "" {
+				cmds = append(cmds, AddRecoveryPassphrase(p, conf.Disk.EncryptionPasswd, conf.Disk.RecoveryPasswd, conf.Yubikey))
 			}
 		} else {
 			cmds = append(cmds, FormatPartition(p))
@@ -75,15 +90,9 @@ func FormattingCommands(conf configuration.Conf) (cmds []Command) {
 func PartitioningTableCommand(d disk.Disk) (cmd Command) {
 	switch d.PartitionTable {
 	case disk.Mbr:
-		cmd = ShellCommand{
-			Label: fmt.Sprintf("Formatting %s to MBR", d.Name),
-			Cmd:   fmt.Sprintf("parted -s /dev/%s -- mklabel msdos", d.Name),
-		}
+		cmd = Parted(fmt.Sprintf("Formatting %s to MBR", d.Name), d, "mklabel", "msdos")
 	case disk.Gpt:
-		cmd = ShellCommand{
-			Label: fmt.Sprintf("Formatting %s to GPT", d.Name),
-			Cmd:   fmt.Sprintf("parted -s /dev/%s -- mklabel gpt", d.Name),
-		}
+		cmd = Parted(fmt.Sprintf("Formatting %s to GPT", d.Name), d, "mklabel", "gpt")
 	default:
 		util.ExitIfErr(fmt.Errorf("unrecognized partitioning scheme %s! Aborting... ", d.PartitionTable))
 	}
@@ -91,38 +100,122 @@ func PartitioningTableCommand(d disk.Disk) (cmd Command) {
 	return
 }
 
-func DiskCommands(conf configuration.Conf) (cmds []Command) {
+func Parted(label string, d disk.Disk, args ...string) Command {
+	return ExecCommand{
+		Label:   label,
+		Program: "parted",
+		Args:    append([]string{"-s", "/dev/" + d.Name, "--"}, args...),
+	}
+}
+
+// DEVICETIMEOUT is how many seconds udev gets to process its events
+const DEVICETIMEOUT = 30
+
+// DEVICEPOLICY checks for a device node for 31 seconds,
+// scripts only sleep whole seconds between the checks
+var DEVICEPOLICY = Policy{Retries: 5, Backoff: time.Second}
+
+// WaitForPartitions lets udev catch up with the new partition table before the partitions are used
+func WaitForPartitions(conf configuration.Conf) (cmds []Command) {
+	cmds = append(cmds,
+		ExecCommand{
+			Label:   "Re-read the partition table of /dev/" + conf.Disk.Name,
+			Program: "partprobe",
+			Args:    []string{"/dev/" + conf.Disk.Name},
+		},
+		SettleUdev(),
+	)
+	for _, p := range conf.Disk.Partitions {
+		cmds = append(cmds, WaitForDevice(p.Path))
+	}
+	return
+}
+
+func SettleUdev() Command {
+	return ExecCommand{
+		Label:   "Wait for udev to process its events",
+		Program: "udevadm",
+		Args:    []string{"settle", fmt.Sprintf("--timeout=%d", DEVICETIMEOUT)},
+	}
+}
+
+// WaitForDevice checks for a block device until it shows up, see DEVICEPOLICY
+func WaitForDevice(path string) Command {
+	policy := DEVICEPOLICY
+	policy.GiveUp = path + " didn't appear"
+	return ExecCommand{
+		Label:   "Wait for " + path,
+		Program: "test",
+		Args:    []string{"-b", path},
+		Policy:  policy,
+	}
+}
+
+func PartitionDisk(conf configuration.Conf) (cmds []Command) {
 	cmds = append(cmds, PartitioningTableCommand(conf.Disk))
 	cmds = append(cmds, PartitioningCommands(conf.Disk, conf.Firmware)...)
+	return
+}
+
+func FormatDisk(conf configuration.Conf) (cmds []Command) {
 	cmds = append(cmds, FormattingCommands(conf)...)
+	cmds = append(cmds, ResolveLuksUUIDs(conf)...)
+	cmds = append(cmds, EscrowRecoveryPassphrase(conf)...)
+	cmds = append(cmds, BackupLuksHeaders(conf)...)
+	return
+}
+
+func MountPartitions(conf configuration.Conf) (cmds []Command) {
+	if conf.IsImpermanent() {
+		cmds = append(cmds, MountTmpfs("/mnt", conf.MountOptions["/"]...)...)
+	}
+
+	for _, p := range conf.Disk.MountedPartitions() {
+		to := filepath.Join("/mnt", p.Mountpoint)
+		if conf.Disk.Encrypt && !p.Bootable {
+			cmds = append(cmds, MountDir("/dev/mapper/"+p.Label, to, p.MountOptions...)...)
+		} else {
+			cmds = append(cmds, MountByLabel(p.Label, to, p.MountOptions...)...)
+		}
+	}
+
+	if conf.IsImpermanent() {
+		cmds = append(cmds, CreateDir(filepath.Join("/mnt", PERSISTSTORAGE)))
+		cmds = append(cmds, BindMount(filepath.Join("/mnt", PERSISTSTORAGE), filepath.Join("/mnt", PERSISTDIR))...)
+	}
+
 	return
 }
 
 func FormatPartition(p disk.Partition) Command {
-	var labelArgs string
+	var labelArgs []string
 	switch p.Format {
 	case disk.Ext4:
-		labelArgs = "-L " + p.Label
+		labelArgs = []string{"-L", p.Label}
 	case disk.Fat32:
-		labelArgs = "-n " + p.Label
+		labelArgs = []string{"-n", p.Label}
 	default:
 		util.ExitIfErr(fmt.Errorf("unrecognized filesystem %s! Aborting... ", p.Format))
 	}
 	if p.Label == "" {
-		labelArgs = ""
+		labelArgs = nil
 	}
 
-	cmd := ShellCommand{
+	cmd := ExecCommand{
 		Label: fmt.Sprintf("Formatting %s to %s", p.Path, p.Format),
 	}
 	switch p.Format {
 	case disk.Ext4:
-		cmd.Cmd = fmt.Sprintf("mkfs.ext4 %s %s", labelArgs, p.Path)
+		cmd.Program = "mkfs.ext4"
 	case disk.Fat32:
-		cmd.Cmd = fmt.Sprintf("mkfs.fat -F32 %s %s", labelArgs, p.Path)
+		cmd.Program = "mkfs.fat"
+		cmd.Args = []string{"-F32"}
 	default:
 		util.ExitIfErr(fmt.Errorf("unrecognized filesystem %s! Aborting... ", p.Format))
 	}
+	cmd.Args = append(cmd.Args, labelArgs...)
+	cmd.Args = append(cmd.Args, p.FormatOptions...)
+	cmd.Args = append(cmd.Args, p.Path)
 
 	return cmd
 }
@@ -134,48 +227,255 @@ func FormatPartitionMapped(p disk.Partition) Command {
 	return FormatPartition(p)
 }
 
-func FormatAndEncryptPartition(p disk.Partition, encryptionPasswd string) []Command {
+// LuksDevice are the cryptsetup device arguments including a detached header
+func LuksDevice(p disk.Partition) []string {
+	if p.LuksHeader != "" {
+		return []string{p.Path, "--header", p.LuksHeader}
+	}
+	return []string{p.Path}
+}
+
+func Cryptsetup(label, action string, p disk.Partition, stdin *Secret, args ...string) ExecCommand {
+	return ExecCommand{
+		Label:   label,
+		Program: "cryptsetup",
+		Args:    append(append([]string{action}, LuksDevice(p)...), args...),
+		Stdin:   stdin,
+	}
+}
+
+// LuksHeaderDevice is where the LUKS header of the partition lives
+func LuksHeaderDevice(p disk.Partition) string {
+	if p.LuksHeader != "" {
+		return p.LuksHeader
+	}
+	return p.Path
+}
+
+func BackupLuksHeaders(conf configuration.Conf) (cmds []Command) {
+	if !conf.Disk.Encrypt || conf.HeaderBackupDir == "" {
+		return
+	}
+
+	cmds = append(cmds, CreateDir(conf.HeaderBackupDir))
+
+	for _, p := range conf.Disk.Partitions {
+		if p.Bootable {
+			continue
+		}
+
+		backup := fmt.Sprintf("%s-%s-header.img", conf.Hostname, p.Label)
+
+		cmds = append(cmds,
+			Cryptsetup(
+				fmt.Sprintf("Backup the LUKS header of %s to %s", p.Path, conf.HeaderBackupDir),
+				"luksHeaderBackup",
+				p,
+				nil,
+				"--header-backup-file", filepath.Join(conf.HeaderBackupDir, backup),
+			),
+			ShellCommand{
+				Label: "Record the checksum of " + backup,
+				Cmd:   fmt.Sprintf("cd %s && sha256sum %s >> SHA256SUMS", util.ShellQuote(conf.HeaderBackupDir), util.ShellQuote(backup)),
+			},
+		)
+	}
+
+	return
+}
+
+func FormatAndEncryptPartition(p disk.Partition, encryptionPasswd string, luks disk.LuksParams) (cmds []Command) {
+	return EncryptPartition(p, LuksPassword(encryptionPasswd), luks)
+}
+
+// EncryptPartition formats, opens and formats the mapped partition with the key piped in from the secret
+func EncryptPartition(p disk.Partition, key Secret, luks disk.LuksParams) (cmds []Command) {
+	cmds = append(cmds, Cryptsetup(
+		"Encrypt "+p.Path,
+		"luksFormat",
+		p,
+		&key,
+		append([]string{"--key-file", "-"}, luks.Args()...)...,
+	))
+
+	cmds = append(cmds,
+		Cryptsetup("Open LUKS partition", "luksOpen", p, &key, p.Label, "--key-file", "-"),
+		WaitForDevice("/dev/mapper/"+p.Label),
+		FormatPartitionMapped(p),
+	)
+
+	return
+}
+
+// InstallKeyfile adds a keyfile to the encrypted partitions which the initrd
+// uses to unlock them after GRUB did, it only ever lives on the encrypted root
+func InstallKeyfile(conf configuration.Conf) (cmds []Command) {
+	if !conf.EncryptedBoot() {
+		return
+	}
+
+	keyfile := filepath.Join("/mnt", KEYFILE)
+	cmds = append(cmds,
+		CreateDir(filepath.Dir(keyfile)),
+		ShellCommand{
+			Label: "Generate a random keyfile at " + keyfile,
+			Cmd:   fmt.Sprintf("(umask 077 && dd if=/dev/urandom of=%s bs=512 count=4 status=none)", keyfile),
+		},
+	)
+
+	passwd := LuksPassword(conf.Disk.EncryptionPasswd)
+	for _, p := range conf.Disk.Partitions {
+		if p.Bootable {
+			continue
+		}
+		// The keyfile is random, an expensive PBKDF only slows down booting
+		cmds = append(cmds, Cryptsetup(
+			fmt.Sprintf("Add %s to %s", keyfile, p.Path),
+			"luksAddKey", p, &passwd, keyfile,
+			"--key-file", "-", "--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000",
+		))
+	}
+
+	return
+}
+
+func EnrollTPM2(p disk.Partition, encryptionPasswd, device, pcrs string) Command {
+	passwd := LuksPassword(encryptionPasswd)
+
+	return ShellCommand{
+		Label:   fmt.Sprintf("Enroll TPM2 token for %s bound to PCRs %s", p.Path, pcrs),
+		Secrets: []Secret{passwd},
+		Cmd: fmt.Sprintf(
+			"PASSWORD=%s systemd-cryptenroll --tpm2-device=%s --tpm2-pcrs=%s %s",
+			passwd.Ref(),
+			util.ShellQuote(device),
+			util.ShellQuote(pcrs),
+			util.ShellQuote(p.Path),
+		),
+	}
+}
+
+func EnrollFIDO2(p disk.Partition, encryptionPasswd string, key int) []Command {
+	passwd := LuksPassword(encryptionPasswd)
+
 	return []Command{
+		PromptCommand{
+			Label:  fmt.Sprintf("Wait for FIDO2 key %d", key),
+			Prompt: fmt.Sprintf("Plug in FIDO2 key %d (and only this one)", key),
+		},
 		ShellCommand{
-			Label: "Encrypt " + p.Path,
+			Label:   fmt.Sprintf("Enroll FIDO2 key %d for %s", key, p.Path),
+			Secrets: []Secret{passwd},
 			Cmd: fmt.Sprintf(
-				"echo -n \"%s\" | cryptsetup luksFormat %s --key-file /dev/stdin -M luks2 --pbkdf argon2id -i 5000",
-				util.EscapeBashDoubleQuotes(encryptionPasswd),
-				p.Path,
+				"PASSWORD=%s systemd-cryptenroll --fido2-device=auto --fido2-with-user-presence=yes %s",
+				passwd.Ref(),
+				util.ShellQuote(p.Path),
 			),
 		},
-		ShellCommand{
-			Label: "Open LUKS partition",
+	}
+}
+
+// AddRecoveryPassphrase adds the recovery passphrase as additional keyslot,
+// with a Yubikey the existing key is the derived one
+func AddRecoveryPassphrase(p disk.Partition, encryptionPasswd, recoveryPasswd string, yubikey bool) Command {
+	key := LuksPassword(encryptionPasswd)
+	if yubikey {
+		key = YubikeyLuksPass()
+	}
+	recovery := RecoveryPassphrase(recoveryPasswd)
+
+	cmd := Cryptsetup(
+		"Add the recovery passphrase to "+p.Path,
+		"luksAddKey",
+		p,
+		&key,
+		recovery.Placeholder(), "--key-file", "-",
+	)
+	cmd.Secrets = []Secret{recovery}
+
+	return cmd
+}
+
+func EscrowRecoveryPassphrase(conf configuration.Conf) (cmds []Command) {
+	if !conf.Disk.Encrypt || conf.Disk.RecoveryPasswd == "" {
+		return
+	}
+
+	recovery := RecoveryPassphrase(conf.Disk.RecoveryPasswd)
+
+	cmds = append(cmds, ShellCommand{
+		Label:   "Escrow the recovery passphrase to " + conf.RecoveryEscrow,
+		Secrets: []Secret{recovery},
+		Cmd: fmt.Sprintf(
+			`(umask 077 && printf 'Recovery passphrase for %%s (disk %%s)\n%%s\n' "%s" "%s" %s > %s)`,
+			util.EscapeBashDoubleQuotes(conf.Hostname),
+			util.EscapeBashDoubleQuotes(conf.Disk.Name),
+			recovery.Ref(),
+			util.ShellQuote(conf.RecoveryEscrow),
+		),
+	})
+
+	for _, p := range conf.Disk.Partitions {
+		if p.Bootable {
+			continue
+		}
+		cmds = append(cmds, ShellCommand{
+			Label: fmt.Sprintf("Record the LUKS UUID of %s in %s", p.Path, conf.RecoveryEscrow),
 			Cmd: fmt.Sprintf(
-				"echo -n \"%s\" | cryptsetup luksOpen %s %s --key-file /dev/stdin",
-				util.EscapeBashDoubleQuotes(encryptionPasswd),
-				p.Path,
-				p.Label,
+				`echo "%s: $(cryptsetup luksUUID %s)" >> %s`,
+				util.EscapeBashDoubleQuotes(p.Label),
+				util.ShellQuote(LuksHeaderDevice(p)),
+				util.ShellQuote(conf.RecoveryEscrow),
 			),
-		},
-		FormatPartitionMapped(p),
+		})
 	}
+
+	return
 }
 
-func FormatAndEncryptPartitionWithYubikey(p disk.Partition, encryptionPasswd string, yubikeySlot int) (cmds []Command) {
-	salt_rb := make([]byte, SALT_LENGTH)
-	rand.Read(salt_rb)
-	salt_hex := hex.EncodeToString(salt_rb)
+func FormatAndEncryptPartitionWithYubikey(p disk.Partition, encryptionPasswd string, luks disk.LuksParams, yubikeySlot int, salt_hex string) (cmds []Command) {
+	if salt_hex == "" {
+		salt_hex = util.RandomHex(SALT_LENGTH)
+	}
 
+	cmds = append(cmds, YubikeyLuksPassCommands(encryptionPasswd, yubikeySlot, salt_hex)...)
+
+	cmds = append(cmds, EncryptPartition(p, YubikeyLuksPass(), luks)...)
+
+	cmds = append(cmds, MountByLabel(BOOTLABEL, "/root/boot")...)
+
+	cmds = append(cmds,
+		CreateDir("/root/boot/crypt-storage"),
+		ShellCommand{
+			Label: "Write into Cryptstore",
+			Cmd:   fmt.Sprintf(`echo -ne "%s\n%d" > /root/boot/crypt-storage/default`, salt_hex, ITERATIONS),
+		},
+		Unmount("/root/boot"),
+	)
+
+	return
+}
+
+// YubikeyLuksPassCommands derive the LUKS passphrase from the response of the Yubikey into YUBILUKSPASS
+func YubikeyLuksPassCommands(encryptionPasswd string, yubikeySlot int, salt_hex string) (cmds []Command) {
 	challenge_rb := sha512.Sum512([]byte(salt_hex))
 	challenge_hex := hex.EncodeToString(challenge_rb[:])
 
+	passwd := LuksPassword(encryptionPasswd)
+
 	cmds = append(cmds, ShellCommand{
-		Label:    "Challenge the yubikey to a reponse",
-		Cmd:      fmt.Sprintf("ykchalresp -%d -x %s 2>/dev/null", yubikeySlot, challenge_hex),
-		OutLabel: "YUBI_RESPONSE",
+		Label:     "Challenge the yubikey to a reponse",
+		Cmd:       fmt.Sprintf("ykchalresp -%d -x %s 2>/dev/null", yubikeySlot, challenge_hex),
+		OutLabel:  YUBIRESPONSE,
+		Sensitive: true,
 	})
 
+	// The derived key is kept hex encoded since it may contain null bytes
 	cmds = append(cmds, FuncCommand{
 		Label:    "Hash the yubikey response",
-		OutLabel: "YUBI_LUKS_PASS",
+		OutLabel: YUBILUKSPASS,
 		Cmd: func(state map[string]string) (val string, err error) {
-			yubires_hex := state["YUBI_RESPONSE"]
+			yubires_hex := state[YUBIRESPONSE]
 
 			yubires_rb, err := hex.DecodeString(util.RemoveLinebreaks(yubires_hex))
 			if err != nil {
@@ -184,64 +484,91 @@ func FormatAndEncryptPartitionWithYubikey(p disk.Partition, encryptionPasswd str
 
 			luks_pass := pbkdf2.Key([]byte(encryptionPasswd), yubires_rb, ITERATIONS, KEYLENGTH/8, sha512.New)
 
-			return string(luks_pass), nil
+			return hex.EncodeToString(luks_pass), nil
 		},
-	})
-
-	cmds = append(cmds, ShellCommand{
-		Label:             "Format Cryptsetup",
-		InputPreprocessor: util.EscapeBashDoubleQuotes,
-		Cmd: fmt.Sprintf(
-			`echo -n "$YUBI_LUKS_PASS" | cryptsetup luksFormat --cipher="%s" --key-size="%d" --hash="%s" --key-file=- "%s"`,
-			CIPHER,
-			KEYLENGTH,
-			HASH,
-			p.Path,
+		Shell: fmt.Sprintf(
+			`%s pbkdf2-sha512 %d %d "$YUBI_RESPONSE" | od -An -vtx1 | tr -d ' \n'`,
+			passwd.Stdin(),
+			KEYLENGTH/8,
+			ITERATIONS,
 		),
+		Secrets: []Secret{passwd, YubikeyResponse()},
 	})
 
-	cmds = append(cmds, ShellCommand{
-		Label:             "Open Luks",
-		InputPreprocessor: util.EscapeBashDoubleQuotes,
-		Cmd: fmt.Sprintf(
-			`echo -n "$YUBI_LUKS_PASS" | cryptsetup luksOpen %s %s --key-file=-`,
-			p.Path,
-			p.Label,
-		),
-	})
-
-	cmds = append(cmds, FormatPartitionMapped(p))
-
-	cmds = append(cmds, MountByLabel(BOOTLABEL, "/root/boot")...)
+	return
+}
 
-	cmds = append(cmds,
-		CreateDir("/root/boot/crypt-storage"),
-		ShellCommand{
-			Label: "Write into Cryptstore",
-			Cmd:   fmt.Sprintf(`echo -ne "%s\n%d" > /root/boot/crypt-storage/default`, salt_hex, ITERATIONS),
-		},
-		Unmount("/root/boot"),
-	)
+// Ext4FormatOptions discards the whole partition while formatting on SSDs
+// and explicitly avoids it when discards are turned off
+func Ext4FormatOptions(d disk.Disk) []string {
+	switch {
+	case d.Discard:
+		return []string{"-E", "discard"}
+	case d.SSD:
+		return []string{"-E", "nodiscard"}
+	default:
+		return nil
+	}
+}
 
-	return
+// RootPartitionEnd fills the disk unless the size of the root partition is limited
+func RootPartitionEnd(conf configuration.Conf, startMiB int) string {
+	if conf.RootSizeGB == 0 {
+		return "100%"
+	}
+	return fmt.Sprintf("%dMiB", startMiB+conf.RootSizeGB*1024)
 }
 
 func BIOSDiskSetup(conf configuration.Conf) (configuration.Conf, []Command) {
 	conf.Disk.PartitionTable = disk.Mbr
 
+	root := disk.Partition{
+		Format:        disk.Ext4,
+		FormatOptions: Ext4FormatOptions(conf.Disk),
+		Label:         ROOTLABEL,
+		Path:          "/dev/" + conf.Disk.PartitionName(1),
+		Number:        1,
+		Primary:       true,
+		From:          "1MiB",
+		To:            RootPartitionEnd(conf, 1),
+		Bootable:      false,
+
+		Mountpoint:   conf.RootMountpoint(),
+		MountOptions: conf.MountOptions[conf.RootMountpoint()],
+		LuksHeader:   conf.Disk.DetachedHeader,
+	}
+
+	if !conf.HasBootPartition() {
+		conf.Disk.Partitions = []disk.Partition{root}
+		conf.Disk.RootPartition = 0
+		return conf, []Command{}
+	}
+
+	// GRUB can't read the encrypted root so /boot stays unencrypted,
+	// with impermanence it mustn't end up on the tmpfs
+	root.Path = "/dev/" + conf.Disk.PartitionName(2)
+	root.Number = 2
+	root.From = "512MiB"
+	root.To = RootPartitionEnd(conf, 512)
+
 	conf.Disk.Partitions = []disk.Partition{
 		{
 			Format:   disk.Ext4,
-			Label:    ROOTLABEL,
+			Label:    BOOTLABEL,
 			Path:     "/dev/" + conf.Disk.PartitionName(1),
 			Number:   1,
 			Primary:  true,
 			From:     "1MiB",
-			To:       "100%",
-			Bootable: false,
+			To:       "512MiB",
+			Bootable: true,
+
+			Mountpoint:   conf.BootMountpoint(),
+			MountOptions: conf.MountOptions[conf.BootMountpoint()],
 		},
+		root,
 	}
-	conf.Disk.RootPartition = 0
+	conf.Disk.BootPartition = 0
+	conf.Disk.RootPartition = 1
 
 	return conf, []Command{}
 }
@@ -259,16 +586,24 @@ func UEFIDiskSetup(conf configuration.Conf) (configuration.Conf, []Command) {
 			From:     "4MiB",
 			To:       "512MiB",
 			Bootable: true,
+
+			Mountpoint:   conf.BootMountpoint(),
+			MountOptions: conf.MountOptions[conf.BootMountpoint()],
 		},
 		{
-			Format:   disk.Ext4,
-			Label:    ROOTLABEL,
-			Path:     "/dev/" + conf.Disk.PartitionName(2),
-			Number:   2,
-			Primary:  true,
-			From:     "512MiB",
-			To:       "100%",
-			Bootable: false,
+			Format:        disk.Ext4,
+			FormatOptions: Ext4FormatOptions(conf.Disk),
+			Label:         ROOTLABEL,
+			Path:          "/dev/" + conf.Disk.PartitionName(2),
+			Number:        2,
+			Primary:       true,
+			From:          "512MiB",
+			To:            RootPartitionEnd(conf, 512),
+			Bootable:      false,
+
+			Mountpoint:   conf.RootMountpoint(),
+			MountOptions: conf.MountOptions[conf.RootMountpoint()],
+			LuksHeader:   conf.Disk.DetachedHeader,
 		},
 	}
 	conf.Disk.BootPartition = 0
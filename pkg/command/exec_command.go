@@ -0,0 +1,117 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+// ExecCommand runs a program directly with its arguments, nothing is
+// interpreted by a shell. The shell form only exists for generated scripts.
+type ExecCommand struct {
+	Label    string
+	Program  string
+	Args     []string
+	OutLabel string
+	// Stdin is piped into the program
+	Stdin *Secret
+	// Secrets are passed as files, an argument equal to the placeholder of one is replaced by its path
+	Secrets []Secret
+	// Sensitive output is captured but not echoed
+	Sensitive bool
+	// Env is added to the environment as NAME=value
+	Env    []string
+	Policy Policy
+}
+
+func (c ExecCommand) Message() string {
+	return c.Label
+}
+
+func (c ExecCommand) Execute(ctx context.Context, executor Executor, state map[string]string) (key string, val string, err error) {
+	run := Run{
+		Label:     c.Label,
+		Cmd:       c.shell(),
+		Argv:      append([]string{c.Program}, c.Args...),
+		Env:       c.Env,
+		Sensitive: c.Sensitive,
+	}
+
+	if c.Stdin != nil {
+		stdin := *c.Stdin
+		stdin.Value = stdin.resolve(state)
+		run.Stdin = &stdin
+	}
+
+	for i, s := range c.Secrets {
+		s.Value = s.resolve(state)
+		run.Secrets = append(run.Secrets, s)
+		for j, arg := range run.Argv {
+			if arg == s.Placeholder() {
+				run.Argv[j] = fmt.Sprintf("/dev/fd/%d", 3+i)
+			}
+		}
+	}
+
+	val, err = executor.Run(ctx, run)
+	key = c.OutLabel
+
+	return
+}
+
+func (c ExecCommand) ToShellCommand() (cmd string) {
+	cmd = c.render(c.Policy.timeoutPrefix())
+	if c.OutLabel != "" {
+		cmd = fmt.Sprintf("%s=$(%s)", c.OutLabel, cmd)
+	}
+	return
+}
+
+func (c ExecCommand) shell() string {
+	return c.render("")
+}
+
+// render puts prefix right before the program
+func (c ExecCommand) render(prefix string) string {
+	words := []string{}
+	for _, env := range c.Env {
+		name, value := splitEnv(env)
+		words = append(words, name+"="+util.ShellQuote(value))
+	}
+	words = append(words, prefix+util.ShellQuote(c.Program))
+	for _, arg := range c.Args {
+		words = append(words, c.shellArg(arg))
+	}
+
+	cmd := strings.Join(words, " ")
+	if c.Stdin != nil {
+		cmd = c.Stdin.Stdin() + " " + cmd
+	}
+	return cmd
+}
+
+func (c ExecCommand) shellArg(arg string) string {
+	for _, s := range c.Secrets {
+		if arg == s.Placeholder() {
+			return s.File()
+		}
+	}
+	return util.ShellQuote(arg)
+}
+
+func splitEnv(env string) (name, value string) {
+	if i := strings.Index(env, "="); i >= 0 {
+		return env[:i], env[i+1:]
+	}
+	return env, ""
+}
+
+// allSecrets are the secrets a generated script has to provide
+func (c ExecCommand) allSecrets() []Secret {
+	if c.Stdin == nil {
+		return c.Secrets
+	}
+	return append([]Secret{*c.Stdin}, c.Secrets...)
+}
@@ -0,0 +1,145 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+)
+
+// LOGDIR receives a copy of the execution log on the installed system
+const LOGDIR = "/var/log/nixos-go-up"
+
+// LogDir is LOGDIR below the mounted target, on the persisted storage
+// with impermanence so it survives the tmpfs root
+func LogDir(conf configuration.Conf) string {
+	if conf.IsImpermanent() {
+		return filepath.Join("/mnt", PERSISTSTORAGE, LOGDIR)
+	}
+	return filepath.Join("/mnt", LOGDIR)
+}
+
+// LogRun starts the entries of a run in the log, a resumed
+// installation continues the log of the failed one
+type LogRun struct {
+	Run   string    `json:"run"`
+	Start time.Time `json:"start"`
+}
+
+// LogEntry is one line of the execution log, the command is rendered
+// like in generated scripts so secrets only show up as references
+type LogEntry struct {
+	Label    string    `json:"label"`
+	Phase    string    `json:"phase,omitempty"`
+	Command  string    `json:"command"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_seconds"`
+	ExitCode int       `json:"exit_code"`
+	Stderr   string    `json:"stderr,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// ExecLog writes a JSON object per executed command
+type ExecLog struct {
+	w       io.Writer
+	Entries []LogEntry
+}
+
+func NewExecLog(w io.Writer) *ExecLog {
+	return &ExecLog{w: w}
+}
+
+// Begin writes the header of a run like install or resume
+func (l *ExecLog) Begin(run string, start time.Time) {
+	if l.w == nil {
+		return
+	}
+	line, err := json.Marshal(LogRun{Run: run, Start: start})
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(l.w, "%s\n", line)
+}
+
+func (l *ExecLog) Record(cmd Command, phase string, start, end time.Time, err error) {
+	entry := LogEntry{
+		Label:    cmd.Message(),
+		Phase:    phase,
+		Command:  cmd.ToShellCommand(),
+		Start:    start,
+		End:      end,
+		Duration: end.Sub(start).Seconds(),
+		ExitCode: ExitCode(err),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	var runErr *RunError
+	if errors.As(err, &runErr) {
+		entry.Stderr = runErr.Stderr
+	}
+
+	l.Entries = append(l.Entries, entry)
+
+	if l.w == nil {
+		return
+	}
+	line, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return
+	}
+	fmt.Fprintf(l.w, "%s\n", line)
+}
+
+// ExitCode is -1 for failures which didn't come from a program
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// Summary is the time spent in every phase in the order they ran
+func (l *ExecLog) Summary() (summary string) {
+	phases := []string{}
+	durations := map[string]time.Duration{}
+	for _, e := range l.Entries {
+		if _, ok := durations[e.Phase]; !ok {
+			phases = append(phases, e.Phase)
+		}
+		durations[e.Phase] += e.End.Sub(e.Start)
+	}
+
+	summary = "Timings:\n"
+	total := time.Duration(0)
+	for _, phase := range phases {
+		summary += fmt.Sprintf("  %-10s %s\n", phase, durations[phase].Round(time.Millisecond))
+		total += durations[phase]
+	}
+	summary += fmt.Sprintf("  %-10s %s\n", "total", total.Round(time.Millisecond))
+
+	return
+}
+
+// CopyLog copies the log file to dir, used to keep it on the installed system
+func CopyLog(path, dir string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, filepath.Base(path)), data, 0o600)
+}
@@ -0,0 +1,273 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/events"
+)
+
+// Executor runs the shell commands, a fake one makes the install sequence testable
+type Executor interface {
+	Run(ctx context.Context, run Run) (out string, err error)
+}
+
+// Run is a fully substituted command with the values of its secrets
+type Run struct {
+	Label string
+	// Cmd is run by bash, with Argv it's only shown
+	Cmd string
+	// Argv is run directly, the secrets are passed as files starting at fd 3
+	Argv []string
+	// Env is added to the inherited environment
+	Env       []string
+	Stdin     *Secret
+	Secrets   []Secret
+	Sensitive bool
+}
+
+// Prompter answers PromptCommands without a terminal
+type Prompter interface {
+	Prompt(ctx context.Context, prompt string) error
+}
+
+type BashExecutor struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func NewBashExecutor() BashExecutor {
+	return BashExecutor{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+func (e BashExecutor) Run(ctx context.Context, run Run) (string, error) {
+	fmt.Fprintln(e.Stdout, run.Cmd)
+
+	// bash decodes hex secrets itself, see Secret.Stdin
+	prelude, files, err := secretFiles(run.Secrets, len(run.Argv) > 0)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	stderr := &tailBuffer{}
+	var cmd *exec.Cmd
+	if len(run.Argv) > 0 {
+		cmd = exec.Command(run.Argv[0], run.Argv[1:]...)
+	} else {
+		cmd = exec.Command("bash", "-c", prelude+run.Cmd)
+	}
+
+	cmd.ExtraFiles = files
+	if len(run.Env) > 0 {
+		cmd.Env = append(os.Environ(), run.Env...)
+	}
+	cmd.Stdin = e.Stdin
+	if run.Stdin != nil {
+		stdin, err := run.Stdin.Bytes()
+		if err != nil {
+			return "", err
+		}
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = io.MultiWriter(e.Stdout, &out)
+	cmd.Stderr = io.MultiWriter(e.Stderr, &out, stderr)
+	if run.Sensitive {
+		cmd.Stdout = &out
+	}
+
+	// A process group of its own so a timeout or cancellation also kills what
+	// the command started, those would keep the output pipes open otherwise
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// A background process group is stopped when it reads the terminal,
+	// so like in a shell the command gets it and Ctrl-C only reaches the command
+	if tty := terminal(cmd.Stdin); tty != nil {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = int(tty.Fd())
+		defer takeTerminal(tty)
+	}
+
+	if err = ctx.Err(); err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	if err != nil {
+		err = &RunError{Err: err, Stderr: stderr.String()}
+	}
+
+	return out.String(), err
+}
+
+// EventExecutor runs the commands without a terminal and asks a frontend to confirm the prompts
+type EventExecutor struct {
+	BashExecutor
+	Events *events.Stream
+}
+
+func (e EventExecutor) Prompt(ctx context.Context, prompt string) error {
+	a, err := e.Events.Ask(ctx, events.Event{Kind: events.CONFIRM, Label: prompt})
+	switch {
+	case err != nil:
+		return err
+	case a.Cancel || !a.Confirm:
+		return fmt.Errorf("%s: cancelled", prompt)
+	}
+	return nil
+}
+
+// RunError keeps the end of stderr of a failed command
+type RunError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *RunError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+const stderrTail = 4096
+
+// tailBuffer only keeps the last stderrTail bytes written to it
+type tailBuffer struct {
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > stderrTail {
+		t.buf = t.buf[len(t.buf)-stderrTail:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
+
+// secretFiles passes every secret through a pipe starting at fd 3
+// and reads them into shell variables before the command runs
+func secretFiles(secrets []Secret, decode bool) (prelude string, files []*os.File, err error) {
+	for i, s := range secrets {
+		value := []byte(s.Value)
+		if decode {
+			if value, err = s.Bytes(); err != nil {
+				return "", nil, err
+			}
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			return "", nil, err
+		}
+
+		go func() {
+			w.Write(value)
+			w.Close()
+		}()
+
+		files = append(files, r)
+		prelude += fmt.Sprintf("IFS= read -r -d '' %s <&%d; exec %d<&-; ", s.Name, 3+i, 3+i)
+	}
+	return
+}
+
+// RecordingExecutor doesn't run anything and only records the commands
+type RecordingExecutor struct {
+	Runs []Run
+	// Outputs are returned for the first command containing the key
+	Outputs map[string]string
+	// Fail makes commands containing the key fail
+	Fail map[string]error
+}
+
+func (e *RecordingExecutor) Run(ctx context.Context, run Run) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	e.Runs = append(e.Runs, run)
+
+	for k, err := range e.Fail {
+		if strings.Contains(run.Cmd, k) {
+			return "", err
+		}
+	}
+
+	for k, out := range e.Outputs {
+		if strings.Contains(run.Cmd, k) {
+			return out, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Record renders the recorded commands without the values of the secrets
+func (e *RecordingExecutor) Record() (record string) {
+	for _, run := range e.Runs {
+		record += fmt.Sprintf("# %s\n", run.Label)
+		if run.Stdin != nil {
+			record += fmt.Sprintf("# stdin %s\n", run.Stdin.Name)
+		}
+		for _, s := range run.Secrets {
+			record += fmt.Sprintf("# secret %s\n", s.Name)
+		}
+		record += run.Cmd + "\n\n"
+	}
+	return
+}
+
+// terminal is the file of r if it's a terminal
+func terminal(r io.Reader) *os.File {
+	f, ok := r.(*os.File)
+	if !ok {
+		return nil
+	}
+	var termios syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return nil
+	}
+	return f
+}
+
+// takeTerminal puts the installer back into the foreground after a command,
+// it is in the background by then and would get SIGTTOU
+func takeTerminal(tty *os.File) {
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	pgrp := int32(syscall.Getpgrp())
+	syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&pgrp)))
+}
@@ -1,24 +1,34 @@
 package command
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 type FuncCommand struct {
 	Label    string
 	Cmd      func(state map[string]string) (val string, err error)
 	OutLabel string
+	// Shell does the same as Cmd for generated scripts
+	Shell   string
+	Secrets []Secret
 }
 
 func (f FuncCommand) Message() string {
 	return f.Label
 }
 
-func (f FuncCommand) Execute(state map[string]string) (key string, val string, err error) {
+func (f FuncCommand) Execute(_ context.Context, _ Executor, state map[string]string) (key string, val string, err error) {
 	key = f.OutLabel
 	val, err = f.Cmd(state)
 	return
 }
 
+// ToShellCommand can't run the function, running it without the state
+// could also reveal values derived from secrets
 func (f FuncCommand) ToShellCommand() string {
-	_, res, _ := f.Execute(map[string]string{})
-	return fmt.Sprintf("Result %s = %s", f.OutLabel, res)
-}
\ No newline at end of file
+	if f.Shell == "" {
+		return fmt.Sprintf("# %s is computed by nixos-go-up", f.OutLabel)
+	}
+	return fmt.Sprintf("%s=$(%s)", f.OutLabel, f.Shell)
+}
@@ -0,0 +1,329 @@
+package command_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/command"
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// Salts and challenges are random
+var randomHex = regexp.MustCompile(`[0-9a-f]{32,}`)
+
+func goldenConf() configuration.Conf {
+	return configuration.Conf{
+		Disk: disk.Disk{
+			Name:   "sda",
+			SizeGB: 64,
+			SSD:    true,
+		},
+		Hostname:          "nixos",
+		Timezone:          "Europe/Vienna",
+		Username:          "user",
+		Password:          "password",
+		DesktopEnviroment: configuration.NONE,
+		KeyboardLayout:    "us",
+		Layout:            configuration.Standard,
+		Firmware:          configuration.UEFI,
+		NetInterfaces:     []string{"enp1s0"},
+	}
+}
+
+func TestGenerateCommands_Golden(t *testing.T) {
+	encrypted := func(conf configuration.Conf) configuration.Conf {
+		conf.Disk.Encrypt = true
+		conf.Disk.EncryptionPasswd = "encryption password"
+		conf.Disk.LUKS = disk.DefaultLuksParams()
+		return conf
+	}
+
+	tests := map[string]func(configuration.Conf) configuration.Conf{
+		"uefi": func(conf configuration.Conf) configuration.Conf {
+			return conf
+		},
+		"bios": func(conf configuration.Conf) configuration.Conf {
+			conf.Firmware = configuration.BIOS
+			return conf
+		},
+		"encrypted": encrypted,
+		"bios-encrypted": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.Firmware = configuration.BIOS
+			return conf
+		},
+		"encrypted-boot": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.Disk.InitrdKeyfile = true
+			return conf
+		},
+		"bios-encrypted-boot": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.Firmware = configuration.BIOS
+			conf.Disk.InitrdKeyfile = true
+			return conf
+		},
+		"discard": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.Disk.Discard = true
+			return conf
+		},
+		"yubikey": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.Yubikey = true
+			conf.YubikeySlot = 2
+			return conf
+		},
+		"impermanence": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.Yubikey = true
+			conf.YubikeySlot = 2
+			conf.Layout = configuration.Impermanence
+			conf.MountOptions = map[string][]string{"/": {"size=2G", "mode=755"}}
+			return conf
+		},
+		"secureboot": func(conf configuration.Conf) configuration.Conf {
+			conf.SecureBoot = true
+			conf.SecureBootSetupMode = true
+			conf.EnrollKeys = true
+			return conf
+		},
+		"fido2": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.FIDO2Keys = 2
+			return conf
+		},
+		"secureboot-tpm2": func(conf configuration.Conf) configuration.Conf {
+			conf.Disk.Encrypt = true
+			conf.TPM2 = true
+			conf.TPM2Device = "auto"
+			conf.TPM2PCRs = "0+7"
+			conf.SecureBoot = true
+			conf.SecureBootSetupMode = true
+			conf.EnrollKeys = true
+			return conf
+		},
+		"detached-header": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.Disk.DetachedHeader = "/dev/disk/by-id/usb-Stick_0123-0:0"
+			return conf
+		},
+		"discard-detached-header": func(conf configuration.Conf) configuration.Conf {
+			conf = encrypted(conf)
+			conf.Disk.Discard = true
+			conf.Disk.DetachedHeader = "/dev/disk/by-id/usb-Stick_0123-0:0"
+			return conf
+		},
+		"bios-impermanence": func(conf configuration.Conf) configuration.Conf {
+			conf.Firmware = configuration.BIOS
+			conf.Layout = configuration.Impermanence
+			return conf
+		},
+	}
+
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			conf := modify(goldenConf())
+			cmds := command.GenerateCommands(conf, command.MakeCommandGenerators(conf))
+
+			executor := &command.RecordingExecutor{
+				Outputs: map[string]string{
+					"ykchalresp":       "0123456789abcdef0123456789abcdef01234567\n",
+					"api.github.com":   "89253fb1518063556edd5e54509c30ac3089d5e6",
+					"nix-prefetch-url": "0dbsh5p4sa4gxlbnikl7ga6mvzn2w2c5mfbw4s1wbhdaqfirvyxz\n",
+					"PARTUUID":         "6f1d2b3a-02\n",
+				},
+			}
+			require.NoError(t, command.ExecuteCmds(cmds, executor))
+
+			got := randomHex.ReplaceAllString(executor.Record(), "<hex>")
+
+			golden := filepath.Join("testdata", name+".golden")
+			if *update {
+				require.NoError(t, os.WriteFile(golden, []byte(got), 0o644))
+			}
+
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			require.Equal(t, string(want), got, "Commands differ from %s, rerun with -update if intended", golden)
+		})
+	}
+}
+
+func TestCheckpoint_Resume(t *testing.T) {
+	conf := goldenConf()
+	conf.Disk.Encrypt = true
+	conf.Disk.EncryptionPasswd = "encryption password"
+	conf.Disk.LUKS = disk.DefaultLuksParams()
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cmds := command.GenerateCommands(conf, command.MakeCommandGenerators(conf))
+	cp := command.NewCheckpoint(conf)
+
+	failing := &command.RecordingExecutor{
+		Outputs: map[string]string{"luksUUID": "0f8c5b2e-uuid\n"},
+		Fail:    map[string]error{"nixos-install": fmt.Errorf("substituter unreachable")},
+	}
+	runner := command.Runner{Executor: failing, Done: cp.Track(path)}
+	require.Error(t, runner.Run(context.Background(), cmds, map[string]string{}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), conf.Disk.EncryptionPasswd, "Checkpoint contains the encryption password")
+	require.NotContains(t, string(data), conf.Password, "Checkpoint contains the user password")
+
+	cp, err = command.LoadCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, len(cmds)-1, cp.Completed, "Only nixos-install is left")
+
+	resumed := cp.Conf
+	resumed.Disk.EncryptionPasswd = conf.Disk.EncryptionPasswd
+	resumed.Password = conf.Password
+	cmds, _, err = cp.ResumeCommands(resumed)
+	require.NoError(t, err)
+
+	executor := &command.RecordingExecutor{}
+	runner = command.Runner{Executor: executor, Done: cp.Track(path)}
+	require.NoError(t, runner.Run(context.Background(), cmds, cp.ResumeState()))
+
+	record := executor.Record()
+	require.Contains(t, record, "cryptsetup luksOpen /dev/disk/by-uuid/0f8c5b2e-uuid NIXROOT", "Disk isn't reopened by its UUID")
+	require.Contains(t, record, "mount /dev/mapper/NIXROOT /mnt", "Partitions aren't remounted")
+	require.Contains(t, record, "nixos-install", "Failed step isn't rerun")
+	require.NotContains(t, record, "luksFormat", "Disk is wiped again")
+	require.NotContains(t, record, "nixos-generate-config", "Completed steps are rerun")
+
+	cp, err = command.LoadCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, len(command.GenerateCommands(conf, command.MakeCommandGenerators(conf))), cp.Completed, "Checkpoint isn't complete")
+}
+
+func TestCheckpoint_ResumeImpermanence(t *testing.T) {
+	outputs := map[string]string{
+		"api.github.com":   "89253fb1518063556edd5e54509c30ac3089d5e6",
+		"nix-prefetch-url": "0dbsh5p4sa4gxlbnikl7ga6mvzn2w2c5mfbw4s1wbhdaqfirvyxz\n",
+	}
+
+	tests := map[string]struct {
+		fail     string
+		restored bool
+	}{
+		"config persisted":     {fail: "nixos-install", restored: true},
+		"config not persisted": {fail: "cp -a /mnt/etc/nixos", restored: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			conf := goldenConf()
+			conf.Layout = configuration.Impermanence
+
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			cmds := command.GenerateCommands(conf, command.MakeCommandGenerators(conf))
+			cp := command.NewCheckpoint(conf)
+
+			failing := &command.RecordingExecutor{Outputs: outputs, Fail: map[string]error{test.fail: fmt.Errorf("failed")}}
+			runner := command.Runner{Executor: failing, Done: cp.Track(path)}
+			require.Error(t, runner.Run(context.Background(), cmds, map[string]string{}))
+
+			cp, err := command.LoadCheckpoint(path)
+			require.NoError(t, err)
+
+			resumed := cp.Conf
+			resumed.Password = conf.Password
+			cmds, _, err = cp.ResumeCommands(resumed)
+			require.NoError(t, err)
+
+			executor := &command.RecordingExecutor{Outputs: outputs}
+			runner = command.Runner{Executor: executor, Done: cp.Track(path)}
+			require.NoError(t, runner.Run(context.Background(), cmds, cp.ResumeState()))
+
+			record := executor.Record()
+			require.Contains(t, record, "mount -t tmpfs", "tmpfs root isn't remounted")
+			require.Contains(t, record, "nixos-install", "Failed step isn't rerun")
+			if test.restored {
+				require.Contains(t, record, "cp -a /mnt/nix/persist/etc/nixos /mnt/etc", "Configuration isn't restored onto the tmpfs")
+				require.NotContains(t, record, "nixos-generate-config", "Completed steps are rerun")
+			} else {
+				require.Contains(t, record, "nixos-generate-config", "Configuration lost with the tmpfs isn't generated again")
+				require.Contains(t, record, "/mnt/etc/nixos/configuration.nix", "Configuration lost with the tmpfs isn't written again")
+			}
+
+			cp, err = command.LoadCheckpoint(path)
+			require.NoError(t, err)
+			require.Equal(t, len(command.GenerateCommands(conf, command.MakeCommandGenerators(conf))), cp.Completed, "Checkpoint isn't complete")
+		})
+	}
+}
+
+func TestPlan_Golden(t *testing.T) {
+	conf := goldenConf()
+	conf.Disk.Encrypt = true
+	conf.Disk.EncryptionPasswd = "encryption password"
+	conf.Disk.LUKS = disk.DefaultLuksParams()
+
+	existing, err := disk.ParseLsblk([]byte(`{"blockdevices": [{"name": "sda", "type": "disk", "size": 68719476736, "children": [
+		{"name": "sda1", "type": "part", "size": 104857600, "fstype": "vfat", "label": "EFI"},
+		{"name": "sda2", "type": "part", "size": "68612735488", "fstype": "ntfs", "label": "Windows"}
+	]}]}`))
+	require.NoError(t, err)
+
+	got := command.Plan(conf, existing)
+
+	golden := filepath.Join("testdata", "plan.golden")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, []byte(got), 0o644))
+	}
+
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	require.Equal(t, string(want), got, "Plan differs from %s, rerun with -update if intended", golden)
+}
+
+func TestPlanFile_RoundTrip(t *testing.T) {
+	conf := goldenConf()
+	conf.Disk.Encrypt = true
+	conf.Disk.EncryptionPasswd = "encryption password"
+	conf.Disk.LUKS = disk.DefaultLuksParams()
+	conf.Yubikey = true
+	conf.YubikeySlot = 2
+	conf.YubikeyBackup = true
+	conf.YubikeySecret = "00112233445566778899aabbccddeeff00112233"
+	conf.Password = "user-passw0rd"
+
+	cmds, phases := command.GeneratePhases(conf, command.MakePhases(conf))
+	plan, err := command.NewPlanFile(conf, cmds, phases, []disk.Identity{{Name: "sda", Serial: "S1", SizeBytes: 64 << 30}})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "plan.json")
+	require.NoError(t, plan.Save(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for _, secret := range []string{conf.Disk.EncryptionPasswd, conf.Password, conf.YubikeySecret} {
+		require.NotContains(t, string(data), secret, "Plan contains a secret")
+	}
+
+	loaded, err := command.LoadPlanFile(path)
+	require.NoError(t, err)
+	decoded, decodedPhases, err := loaded.Commands()
+	require.NoError(t, err)
+
+	require.Equal(t, phases, decodedPhases)
+	require.Len(t, decoded, len(cmds))
+	for i := range cmds {
+		require.Equal(t, cmds[i].ToShellCommand(), decoded[i].ToShellCommand(), "%s changed", cmds[i].Message())
+	}
+
+	loaded.Version++
+	_, _, err = loaded.Commands()
+	require.Error(t, err, "Plan of another version is applied")
+}
@@ -0,0 +1,92 @@
+package command
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+)
+
+const (
+	HOOKSDIR = "/etc/nixos-go-up/hooks"
+
+	HOOKPOSTPARTITION = "post-partition"
+	HOOKPOSTMOUNT     = "post-mount"
+	HOOKPOSTINSTALL   = "post-install"
+)
+
+// Hook runs the executables of a hook point, they are looked up when the
+// commands are generated so a plan shows them
+func Hook(name string) CommandGenerator {
+	return Stable(func(conf configuration.Conf) []Command {
+		return HookCommands(conf, name)
+	})
+}
+
+// HookCommands run <dir>/<name> and then everything in <dir>/<name>.d in
+// lexical order, every executable gets the configuration through HookEnv
+func HookCommands(conf configuration.Conf, name string) (cmds []Command) {
+	if conf.HooksDir == "" {
+		return
+	}
+
+	env := HookEnv(conf, name)
+	for _, path := range hookExecutables(conf.HooksDir, name) {
+		cmds = append(cmds, ExecCommand{
+			Label:   "Running " + name + " hook " + filepath.Base(path),
+			Program: path,
+			Env:     env,
+		})
+	}
+	return
+}
+
+func hookExecutables(dir, name string) (paths []string) {
+	single := filepath.Join(dir, name)
+	if isExecutable(single) {
+		paths = append(paths, single)
+	}
+
+	entries, err := os.ReadDir(single + ".d")
+	if err != nil {
+		return
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		path := filepath.Join(single+".d", n)
+		if isExecutable(path) {
+			paths = append(paths, path)
+		}
+	}
+	return
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0o111 != 0
+}
+
+// HookEnv exposes the configuration to a hook, NIXOS_GO_UP_CONF holds all of
+// it as JSON without the secrets
+func HookEnv(conf configuration.Conf, name string) []string {
+	data, _ := json.Marshal(WithoutSecrets(conf))
+
+	return []string{
+		"NIXOS_GO_UP_HOOK=" + name,
+		"NIXOS_GO_UP_ROOT=/mnt",
+		"NIXOS_GO_UP_DISK=/dev/" + conf.Disk.Name,
+		"NIXOS_GO_UP_FIRMWARE=" + string(conf.Firmware),
+		"NIXOS_GO_UP_ENCRYPT=" + strconv.FormatBool(conf.Disk.Encrypt),
+		"NIXOS_GO_UP_HOSTNAME=" + conf.Hostname,
+		"NIXOS_GO_UP_USERNAME=" + conf.Username,
+		"NIXOS_GO_UP_CONF=" + string(data),
+	}
+}
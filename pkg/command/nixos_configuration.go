@@ -3,6 +3,13 @@ package command
 type Replacement struct {
 	Bootloader           string
 	GrubDevice           string
+	FileSystems          string
+	Discard              string
+	Keyfile              string
+	DetachedHeader       string
+	Cryptenroll          string
+	Imports              string
+	Impermanence         string
 	Hostname             string
 	Timezone             string
 	NetworkingInterfaces string
@@ -10,11 +17,12 @@ type Replacement struct {
 	KeyboardLayout       string
 	Username             string
 	PasswordHash         string
+	Packages             string
 }
 
 func NixOSConfiguration() string {
 	return `
-{ config, pkgs, ... }:
+{ config, pkgs, lib, ... }:
 
 {
   # Enable Flake Support
@@ -26,6 +34,7 @@ func NixOSConfiguration() string {
   imports = [
     # Include the results of the hardware scan.
     ./hardware-configuration.nix
+    {{ .Imports }}
   ];
 
   # Use the GRUB 2 boot loader for BIOS and systemd-boot for UEFI
@@ -33,6 +42,24 @@ func NixOSConfiguration() string {
 
   boot.loader.grub.device = "{{ .GrubDevice }}";
 
+  # Mount options, the devices are detected by nixos-generate-config
+  {{ .FileSystems }}
+
+  # TRIM for SSDs
+  {{ .Discard }}
+
+  # Keyfile to unlock the encrypted partitions without asking again after GRUB
+  {{ .Keyfile }}
+
+  # Detached LUKS headers
+  {{ .DetachedHeader }}
+
+  # TPM2 and FIDO2 unlocking
+  {{ .Cryptenroll }}
+
+  # Impermanence, / is a tmpfs and only the persisted paths survive a reboot
+  {{ .Impermanence }}
+
   networking.hostName = "{{ .Hostname }}";
   # networking.wireless.enable = true;  # Enables wireless support via wpa_supplicant.
 
@@ -64,6 +91,7 @@ func NixOSConfiguration() string {
   environment.systemPackages = with pkgs; [
     vim
     git
+    {{ .Packages }}
   ];
 
   # This value determines the NixOS release from which the default
@@ -0,0 +1,191 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+)
+
+// Sections of the disk phase in the plan
+const (
+	PLANWIPE      = "wipe"
+	PLANPARTITION = "partition"
+	PLANENCRYPT   = "encrypt"
+	PLANFORMAT    = "format"
+)
+
+// PlanSection are consecutive commands of the same kind
+type PlanSection struct {
+	Name string
+	Cmds []Command
+}
+
+// Plan describes what the installation is going to do before it is confirmed
+func Plan(conf configuration.Conf, existing []disk.Existing) (plan string) {
+	diskConf, cmds, phases := generatePhases(conf, MakePhases(conf))
+
+	plan += "Resulting disk layout:\n"
+	plan += DiskDiagram(diskConf)
+
+	plan += fmt.Sprintf("\nAll data on /dev/%s will be destroyed:\n", conf.Disk.Name)
+	if len(existing) == 0 {
+		plan += "  no partitions found\n"
+	}
+	for _, e := range existing {
+		plan += fmt.Sprintf("  %s%s  %s  %s\n",
+			strings.Repeat("  ", e.Depth),
+			e.Name,
+			disk.HumanSize(e.SizeBytes),
+			strings.TrimSpace(fmt.Sprintf("%s %s %s", e.Type, e.FSType, quoted(e.Label))),
+		)
+	}
+	if conf.Disk.Encrypt && conf.Disk.DetachedHeader != "" {
+		plan += fmt.Sprintf("  %s is overwritten with the LUKS header\n", conf.Disk.DetachedHeader)
+	}
+
+	plan += "\n" + PlanSteps(cmds, phases)
+
+	if notes := SecureBootNotes(conf); len(notes) > 0 {
+		plan += "\nNotes:\n"
+		for _, note := range notes {
+			plan += "  - " + note + "\n"
+		}
+	}
+
+	return
+}
+
+func PlanSteps(cmds []Command, phases []string) (steps string) {
+	steps = "Steps:\n"
+	for i, section := range PlanSections(cmds, phases) {
+		steps += fmt.Sprintf("%d. %s\n", i+1, section.Name)
+		for _, cmd := range section.Cmds {
+			steps += fmt.Sprintf("   - %s\n", cmd.Message())
+		}
+	}
+	return
+}
+
+// PlanSections groups consecutive commands of the same phase in the order they run,
+// the disk phase is split into wiping, partitioning, encryption and formatting
+func PlanSections(cmds []Command, phases []string) (sections []PlanSection) {
+	for i, cmd := range cmds {
+		name := ""
+		if i < len(phases) {
+			name = phases[i]
+		}
+		if name == PHASEDISK {
+			name = diskSection(cmd)
+		}
+
+		if last := len(sections) - 1; last >= 0 && sections[last].Name == name {
+			sections[last].Cmds = append(sections[last].Cmds, cmd)
+			continue
+		}
+		sections = append(sections, PlanSection{Name: name, Cmds: []Command{cmd}})
+	}
+	return
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// diskSection is the kind of a command of the disk phase, the phase itself if it's none of them
+func diskSection(cmd Command) string {
+	switch c := cmd.(type) {
+	case ExecCommand:
+		switch {
+		case c.Program == "parted" && len(c.Args) > 3 && c.Args[3] == "mklabel":
+			return PLANWIPE
+		case c.Program == "parted" || c.Program == "partprobe" || c.Program == "udevadm":
+			return PLANPARTITION
+		case contains(c.Env, "NIXOS_GO_UP_HOOK="+HOOKPOSTPARTITION):
+			return PLANPARTITION
+		case c.Program == "test" && strings.HasPrefix(c.Args[len(c.Args)-1], "/dev/mapper/"):
+			return PLANENCRYPT
+		case c.Program == "test":
+			return PLANPARTITION
+		case c.Program == "cryptsetup":
+			return PLANENCRYPT
+		case strings.HasPrefix(c.Program, "mkfs."):
+			return PLANFORMAT
+		}
+	case ShellCommand:
+		if strings.Contains(c.Cmd, "systemd-cryptenroll") {
+			return PLANENCRYPT
+		}
+	case PromptCommand:
+		// Only FIDO2 keys are waited for
+		return PLANENCRYPT
+	}
+	return PHASEDISK
+}
+
+// DiskDiagram draws the partitions of the disk with what is stacked on them
+func DiskDiagram(conf configuration.Conf) (diagram string) {
+	d := conf.Disk
+
+	kind := "HDD"
+	if d.SSD {
+		kind = "SSD"
+	}
+	diagram += fmt.Sprintf("/dev/%s  %d GiB %s, %s partition table\n", d.Name, d.SizeGB, kind, strings.ToUpper(string(d.PartitionTable)))
+
+	for i, p := range d.Partitions {
+		branch, indent := "├── ", "│   "
+		if i == len(d.Partitions)-1 {
+			branch, indent = "└── ", "    "
+		}
+
+		diagram += fmt.Sprintf("%s%s  %s-%s%s", branch, p.Path, p.From, p.To, partitionSize(d, p))
+
+		if d.Encrypt && !p.Bootable {
+			diagram += fmt.Sprintf("  LUKS2 %s", conf.LuksParams())
+			if p.LuksHeader != "" {
+				diagram += ", header on " + p.LuksHeader
+			}
+			diagram += "\n"
+			diagram += fmt.Sprintf("%s└── /dev/mapper/%s  %s%s\n", indent, p.Label, p.Format, mountpoint(p))
+			continue
+		}
+
+		diagram += fmt.Sprintf("  %s %s%s\n", p.Format, p.Label, mountpoint(p))
+	}
+
+	if conf.IsImpermanent() {
+		diagram += fmt.Sprintf("tmpfs  → /, %s is bind mounted from %s\n", PERSISTDIR, PERSISTSTORAGE)
+	}
+
+	return
+}
+
+func partitionSize(d disk.Disk, p disk.Partition) string {
+	from, okFrom := d.SizeMiB(p.From)
+	to, okTo := d.SizeMiB(p.To)
+	if !okFrom || !okTo || to <= from {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", disk.HumanSize(int64((to-from)*1024*1024)))
+}
+
+func mountpoint(p disk.Partition) string {
+	if p.Mountpoint == "" {
+		return ""
+	}
+	return "  → " + p.Mountpoint
+}
+
+func quoted(s string) string {
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf("%q", s)
+}
@@ -0,0 +1,249 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+// PLANVERSION changes whenever plans of older versions can't be applied anymore
+const PLANVERSION = 1
+
+// PlanFile is a reviewable installation, secrets are only referenced by name
+type PlanFile struct {
+	Version int                `json:"version"`
+	Conf    configuration.Conf `json:"configuration"`
+	Disks   []disk.Identity    `json:"disks"`
+	Steps   []Step             `json:"steps"`
+}
+
+// Step is a serialized ShellCommand, ExecCommand or PromptCommand
+type Step struct {
+	Phase      string      `json:"phase"`
+	Label      string      `json:"label"`
+	Shell      string      `json:"shell,omitempty"`
+	Program    string      `json:"program,omitempty"`
+	Args       []string    `json:"args,omitempty"`
+	Env        []string    `json:"env,omitempty"`
+	OutLabel   string      `json:"out,omitempty"`
+	Preprocess string      `json:"preprocess,omitempty"`
+	Stdin      *SecretRef  `json:"stdin,omitempty"`
+	Secrets    []SecretRef `json:"secrets,omitempty"`
+	Sensitive  bool        `json:"sensitive,omitempty"`
+	Policy     *Policy     `json:"policy,omitempty"`
+	Prompt     string      `json:"prompt,omitempty"`
+}
+
+// SecretRef is a Secret without its value
+type SecretRef struct {
+	Name      string `json:"name"`
+	Prompt    string `json:"prompt,omitempty"`
+	FromState bool   `json:"from_state,omitempty"`
+	Hex       bool   `json:"hex,omitempty"`
+}
+
+// preprocessors can be referenced by name in plans
+var preprocessors = map[string]func(string) string{
+	"RemoveLinebreaks": util.RemoveLinebreaks,
+}
+
+func NewPlanFile(conf configuration.Conf, cmds []Command, phases []string, disks []disk.Identity) (plan PlanFile, err error) {
+	plan = PlanFile{
+		Version: PLANVERSION,
+		Conf:    WithoutSecrets(conf),
+		Disks:   disks,
+	}
+
+	for i, cmd := range cmds {
+		step, err := NewStep(cmd)
+		if err != nil {
+			return PlanFile{}, err
+		}
+		if i < len(phases) {
+			step.Phase = phases[i]
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	return
+}
+
+// NewStep serializes a command, functions are replaced by their shell version
+func NewStep(cmd Command) (step Step, err error) {
+	switch c := cmd.(type) {
+	case ShellCommand:
+		step = Step{Label: c.Label, Shell: c.Cmd, OutLabel: c.OutLabel, Secrets: refs(c.Secrets), Sensitive: c.Sensitive, Policy: policyRef(c.Policy)}
+		if c.InputPreprocessor != nil {
+			step.Preprocess = funcName(c.InputPreprocessor)
+			if _, ok := preprocessors[step.Preprocess]; !ok {
+				return step, fmt.Errorf("%s: can't serialize the input preprocessor %s", c.Label, step.Preprocess)
+			}
+		}
+	case ExecCommand:
+		step = Step{Label: c.Label, Program: c.Program, Args: c.Args, Env: c.Env, OutLabel: c.OutLabel, Secrets: refs(c.Secrets), Sensitive: c.Sensitive, Policy: policyRef(c.Policy)}
+		if c.Stdin != nil {
+			stdin := ref(*c.Stdin)
+			step.Stdin = &stdin
+		}
+	case PromptCommand:
+		step = Step{Label: c.Label, Prompt: c.Prompt}
+	case FuncCommand:
+		if c.Shell == "" {
+			return step, fmt.Errorf("%s: can't serialize a function without a shell version", c.Label)
+		}
+		// The output is derived from secrets
+		step = Step{Label: c.Label, Shell: c.Shell, OutLabel: c.OutLabel, Secrets: refs(c.Secrets), Sensitive: true}
+	default:
+		return step, fmt.Errorf("%s: can't serialize %T", cmd.Message(), cmd)
+	}
+	return
+}
+
+func (p PlanFile) Commands() (cmds []Command, phases []string, err error) {
+	if p.Version != PLANVERSION {
+		return nil, nil, fmt.Errorf("plan version %d can't be applied, expected version %d", p.Version, PLANVERSION)
+	}
+
+	for _, step := range p.Steps {
+		cmd, err := step.Command()
+		if err != nil {
+			return nil, nil, err
+		}
+		cmds = append(cmds, cmd)
+		phases = append(phases, step.Phase)
+	}
+	return
+}
+
+func (s Step) Command() (Command, error) {
+	if s.Prompt != "" {
+		return PromptCommand{Label: s.Label, Prompt: s.Prompt}, nil
+	}
+
+	if s.Program != "" {
+		cmd := ExecCommand{Label: s.Label, Program: s.Program, Args: s.Args, Env: s.Env, OutLabel: s.OutLabel, Secrets: secrets(s.Secrets), Sensitive: s.Sensitive, Policy: s.policy()}
+		if s.Stdin != nil {
+			stdin := s.Stdin.Secret()
+			cmd.Stdin = &stdin
+		}
+		return cmd, nil
+	}
+
+	cmd := ShellCommand{Label: s.Label, Cmd: s.Shell, OutLabel: s.OutLabel, Secrets: secrets(s.Secrets), Sensitive: s.Sensitive, Policy: s.policy()}
+	if s.Preprocess != "" {
+		f, ok := preprocessors[s.Preprocess]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown input preprocessor %s", s.Label, s.Preprocess)
+		}
+		cmd.InputPreprocessor = f
+	}
+	return cmd, nil
+}
+
+// policyRef leaves out policies which don't change anything
+func policyRef(p Policy) *Policy {
+	if p.Timeout == 0 && p.Retries == 0 {
+		return nil
+	}
+	return &p
+}
+
+func (s Step) policy() Policy {
+	if s.Policy == nil {
+		return Policy{}
+	}
+	return *s.Policy
+}
+
+// VerifyDisks refuses plans for disks which were replaced since
+func (p PlanFile) VerifyDisks() error {
+	for _, id := range p.Disks {
+		if err := id.Verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p PlanFile) Save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+func LoadPlanFile(path string) (plan PlanFile, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &plan)
+	return
+}
+
+// WithSecrets fills in the values of the referenced secrets of the commands
+func WithSecrets(cmds []Command, values map[string]string) (filled []Command) {
+	fill := func(secrets []Secret) (res []Secret) {
+		for _, s := range secrets {
+			if !s.FromState {
+				s.Value = values[s.Name]
+			}
+			res = append(res, s)
+		}
+		return
+	}
+
+	for _, cmd := range cmds {
+		switch c := cmd.(type) {
+		case ShellCommand:
+			c.Secrets = fill(c.Secrets)
+			cmd = c
+		case ExecCommand:
+			c.Secrets = fill(c.Secrets)
+			if c.Stdin != nil {
+				c.Stdin = &fill([]Secret{*c.Stdin})[0]
+			}
+			cmd = c
+		case FuncCommand:
+			c.Secrets = fill(c.Secrets)
+			cmd = c
+		}
+		filled = append(filled, cmd)
+	}
+	return
+}
+
+func ref(s Secret) SecretRef {
+	return SecretRef{Name: s.Name, Prompt: s.Prompt, FromState: s.FromState, Hex: s.Hex}
+}
+
+func refs(secrets []Secret) (res []SecretRef) {
+	for _, s := range secrets {
+		res = append(res, ref(s))
+	}
+	return
+}
+
+func (r SecretRef) Secret() Secret {
+	return Secret{Name: r.Name, Prompt: r.Prompt, FromState: r.FromState, Hex: r.Hex}
+}
+
+func secrets(refs []SecretRef) (res []Secret) {
+	for _, r := range refs {
+		res = append(res, r.Secret())
+	}
+	return
+}
+
+func funcName(f interface{}) string {
+	name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
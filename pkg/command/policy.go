@@ -0,0 +1,210 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+// SUBSTITUTERERRORS show up in the stderr of nix when a binary cache can't be reached
+var SUBSTITUTERERRORS = []string{
+	"unable to download",
+	"usually happens due to networking issues",
+	"Couldn't resolve host name",
+	"Timeout was reached",
+}
+
+// Policy limits how long a command may run and whether it's tried again after failing
+type Policy struct {
+	// Timeout of a single attempt, none if 0
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Retries are the attempts after the first one
+	Retries int `json:"retries,omitempty"`
+	// Backoff is the wait before the first retry, it doubles with every one after
+	Backoff time.Duration `json:"backoff,omitempty"`
+	// ExitCodes and Errors in stderr which are worth a retry, any failure is if both are empty.
+	// A timed out attempt is always retried.
+	ExitCodes []int    `json:"exit_codes,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+	// GiveUp describes the failure after the last retry, the total wait is appended
+	GiveUp string `json:"give_up,omitempty"`
+}
+
+// TimeoutError is returned when a single attempt took longer than its timeout
+type TimeoutError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s: %v", e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func policyOf(cmd Command) Policy {
+	switch c := cmd.(type) {
+	case ShellCommand:
+		return c.Policy
+	case ExecCommand:
+		return c.Policy
+	}
+	return Policy{}
+}
+
+// Retryable tells whether the policy allows another attempt after err
+func (p Policy) Retryable(err error) bool {
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) {
+		return true
+	}
+	if interrupted(err) {
+		return false
+	}
+	if len(p.ExitCodes) == 0 && len(p.Errors) == 0 {
+		return true
+	}
+
+	code := ExitCode(err)
+	for _, c := range p.ExitCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	var runErr *RunError
+	if errors.As(err, &runErr) {
+		for _, e := range p.Errors {
+			if strings.Contains(runErr.Stderr, e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// interrupted is true if the command was stopped with Ctrl-C, on a terminal
+// only the command gets it, see BashExecutor.Run
+func interrupted(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGINT
+}
+
+func (p Policy) backoff(retry int) time.Duration {
+	return p.Backoff << retry
+}
+
+// wait is the time slept between all attempts
+func (p Policy) wait() (total time.Duration) {
+	for retry := 0; retry < p.Retries; retry++ {
+		total += p.backoff(retry)
+	}
+	return
+}
+
+func (p Policy) giveUp() string {
+	return fmt.Sprintf("%s within %s", p.GiveUp, p.wait())
+}
+
+// execute runs every attempt the policy allows, log is called after each of them
+func (p Policy) execute(ctx context.Context, cmd Command, executor Executor, state map[string]string, log func(attempt int, start time.Time, err error)) (key, val string, err error) {
+	for retry := 0; ; retry++ {
+		start := time.Now()
+		key, val, err = p.attempt(ctx, cmd, executor, state)
+		log(retry+1, start, err)
+
+		if err != nil && retry >= p.Retries && p.Retries > 0 && p.GiveUp != "" && ctx.Err() == nil {
+			return key, val, fmt.Errorf("%s: %w", p.giveUp(), err)
+		}
+		if err == nil || retry >= p.Retries || ctx.Err() != nil || !p.Retryable(err) {
+			return
+		}
+
+		wait := p.backoff(retry)
+		fmt.Fprintf(util.Out, "%s failed, retrying in %s (%d/%d): %v\n", cmd.Message(), wait, retry+1, p.Retries, err)
+		select {
+		case <-ctx.Done():
+			return key, val, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (p Policy) attempt(ctx context.Context, cmd Command, executor Executor, state map[string]string) (key, val string, err error) {
+	if p.Timeout == 0 {
+		return cmd.Execute(ctx, executor, state)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	key, val, err = cmd.Execute(attemptCtx, executor, state)
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		err = &TimeoutError{Timeout: p.Timeout, Err: err}
+	}
+	return
+}
+
+// timeoutPrefix runs a program of a generated script with coreutils timeout
+func (p Policy) timeoutPrefix() string {
+	if p.Timeout == 0 {
+		return ""
+	}
+	return fmt.Sprintf("timeout --foreground %ds ", int(p.Timeout.Seconds()))
+}
+
+// retryLoop wraps a command of a generated script in the retries of the policy.
+// The script can't look at stderr so without exit codes every failure is retried.
+func (p Policy) retryLoop(cmd string) string {
+	if p.Retries == 0 {
+		return cmd
+	}
+
+	attempts := p.Retries + 1
+	retryable := ""
+	if len(p.ExitCodes) > 0 {
+		codes := []string{}
+		if p.Timeout > 0 {
+			codes = append(codes, "124")
+		}
+		for _, c := range p.ExitCodes {
+			codes = append(codes, strconv.Itoa(c))
+		}
+		retryable = fmt.Sprintf(` || [[ " %s " != *" $status "* ]]`, strings.Join(codes, " "))
+	}
+
+	giveUp := ""
+	if p.GiveUp != "" {
+		giveUp = fmt.Sprintf("\n\t\techo %s >&2", util.ShellQuote(p.giveUp()))
+		// Failures which aren't retryable leave the loop early
+		if retryable != "" {
+			giveUp = fmt.Sprintf("\n\t\tif [ \"$attempt\" -eq %d ]; then echo %s >&2; fi", attempts, util.ShellQuote(p.giveUp()))
+		}
+	}
+
+	return fmt.Sprintf(`for attempt in $(seq %d); do
+	if %s; then
+		break
+	else
+		status=$?
+	fi
+	if [ "$attempt" -eq %d ]%s; then%s
+		exit "$status"
+	fi
+	sleep $((%d * 2 ** (attempt - 1)))
+done`,
+		attempts, cmd, attempts, retryable, giveUp, int(p.Backoff.Seconds()))
+}
@@ -0,0 +1,32 @@
+package command
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+// PromptCommand waits until the user did something like plugging in a key,
+// an executor which is a Prompter asks for it itself
+type PromptCommand struct {
+	Label  string
+	Prompt string
+}
+
+func (c PromptCommand) Message() string {
+	return c.Label
+}
+
+func (c PromptCommand) Execute(ctx context.Context, executor Executor, _ map[string]string) (key string, val string, err error) {
+	if p, ok := executor.(Prompter); ok {
+		return "", "", p.Prompt(ctx, c.Prompt)
+	}
+
+	_, err = executor.Run(ctx, Run{Label: c.Label, Cmd: c.ToShellCommand()})
+	return
+}
+
+func (c PromptCommand) ToShellCommand() string {
+	return fmt.Sprintf(`read -r -p "%s and press enter"`, util.EscapeBashDoubleQuotes(c.Prompt))
+}
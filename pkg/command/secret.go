@@ -0,0 +1,150 @@
+package command
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+const (
+	LUKSPASSWORD       = "LUKS_PASSWORD"
+	RECOVERYPASSPHRASE = "RECOVERY_PASSPHRASE"
+	USERPASSWORDHASH   = "USER_PASSWORD_HASH"
+	YUBILUKSPASS       = "YUBI_LUKS_PASS"
+	YUBIKEYSECRET      = "YUBIKEY_SECRET"
+	YUBIRESPONSE       = "YUBI_RESPONSE"
+
+	secretMask = "********"
+)
+
+// Secret is handed to the shell through a file descriptor and read into a
+// non exported variable of the same name. Commands only ever contain a
+// reference to that variable so the value never shows up in argv or output.
+type Secret struct {
+	Name  string
+	Value string
+	// Prompt asks for the secret when running a generated script
+	Prompt string
+	// ScriptInit replaces the prompt in generated scripts
+	ScriptInit string
+	// FromState takes the value from the state of a previous command
+	FromState bool
+	// Hex values are decoded to raw bytes when piped into a command
+	Hex bool
+}
+
+func (s Secret) String() string {
+	return secretMask
+}
+
+func (s Secret) GoString() string {
+	return fmt.Sprintf("Secret{Name: %q, Value: %q}", s.Name, secretMask)
+}
+
+func (s Secret) Ref() string {
+	return fmt.Sprintf(`"$%s"`, s.Name)
+}
+
+// Stdin pipes the secret into the command following it
+func (s Secret) Stdin() string {
+	if s.Hex {
+		return fmt.Sprintf(`printf "$(sed 's/../\\x&/g' <<< %s)" |`, s.Ref())
+	}
+	return fmt.Sprintf(`printf '%%s' %s |`, s.Ref())
+}
+
+// Bytes are what is piped into a program that isn't run by a shell
+func (s Secret) Bytes() ([]byte, error) {
+	if s.Hex {
+		return hex.DecodeString(s.Value)
+	}
+	return []byte(s.Value), nil
+}
+
+// File is a path the command can read the secret from
+func (s Secret) File() string {
+	return fmt.Sprintf(`<(printf '%%s' %s)`, s.Ref())
+}
+
+// Placeholder marks where the secret goes in file contents, see WriteSecretsToFile
+func (s Secret) Placeholder() string {
+	return "@" + s.Name + "@"
+}
+
+// ScriptPrompt reads the secret in a generated script
+func (s Secret) ScriptPrompt() string {
+	if s.ScriptInit != "" {
+		return s.ScriptInit
+	}
+	return ReadSecretScript(s.Name, s.Prompt)
+}
+
+// ReadSecretScript reads a secret twice without echoing it until both match
+func ReadSecretScript(name, prompt string) string {
+	return fmt.Sprintf(`while true; do
+  read -r -s -p "%s: " %s; echo
+  read -r -s -p "Repeat %s: " %s_CHECK; echo
+  [ "$%s" = "$%s_CHECK" ] && break
+  echo "Secrets don't match! Try again!"
+done
+unset %s_CHECK`, prompt, name, prompt, name, name, name, name)
+}
+
+// Ask fills in the value of a secret referenced by a plan file,
+// a new Yubikey secret is generated like in scripts
+func (s Secret) Ask(ask func(label string) string) Secret {
+	switch s.Name {
+	case USERPASSWORDHASH:
+		s.Value = util.MkPasswd(ask("User password"))
+	case YUBIKEYSECRET:
+		s.Value = util.RandomHex(20)
+	default:
+		s.Value = ask(s.Prompt)
+	}
+	return s
+}
+
+// resolve strips trailing newlines of outputs like a command substitution
+func (s Secret) resolve(state map[string]string) string {
+	if s.FromState {
+		return strings.TrimRight(state[s.Name], "\n")
+	}
+	return s.Value
+}
+
+func LuksPassword(passwd string) Secret {
+	return Secret{Name: LUKSPASSWORD, Value: passwd, Prompt: "Encryption password"}
+}
+
+func RecoveryPassphrase(passwd string) Secret {
+	return Secret{Name: RECOVERYPASSPHRASE, Value: passwd, Prompt: "Recovery passphrase"}
+}
+
+func UserPasswordHash(hash string) Secret {
+	return Secret{
+		Name:  USERPASSWORDHASH,
+		Value: hash,
+		ScriptInit: ReadSecretScript("USER_PASSWORD", "User password") +
+			fmt.Sprintf("\n%s=$(mkpasswd -m sha-512 -s <<< \"$USER_PASSWORD\")\nunset USER_PASSWORD", USERPASSWORDHASH),
+	}
+}
+
+// YubikeySecret is the HMAC-SHA1 secret programmed into the Yubikeys,
+// scripts generate a new one
+func YubikeySecret(secret string) Secret {
+	return Secret{
+		Name:       YUBIKEYSECRET,
+		Value:      secret,
+		ScriptInit: fmt.Sprintf("%s=$(od -An -vtx1 -N20 /dev/urandom | tr -d ' \\n')", YUBIKEYSECRET),
+	}
+}
+
+func YubikeyResponse() Secret {
+	return Secret{Name: YUBIRESPONSE, FromState: true}
+}
+
+func YubikeyLuksPass() Secret {
+	return Secret{Name: YUBILUKSPASS, FromState: true, Hex: true}
+}
@@ -0,0 +1,90 @@
+package command
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+)
+
+const (
+	SECUREBOOTDIR = "/etc/secureboot"
+	LANZABOOTE    = "github:nix-community/lanzaboote/v0.3.0"
+
+	// sbctl only enrolls keys from its default location
+	SBCTLKEYDIR = "/usr/share/secureboot"
+)
+
+func SecureBootKeyCommands(conf configuration.Conf) (cmds []Command) {
+	if !conf.SecureBoot {
+		return
+	}
+
+	keys := filepath.Join("/mnt", SECUREBOOTDIR)
+
+	if conf.IsImpermanent() {
+		persisted := filepath.Join("/mnt", PERSISTSTORAGE, SECUREBOOTDIR)
+		cmds = append(cmds, CreateDir(persisted))
+		cmds = append(cmds, BindMount(persisted, keys)...)
+	}
+
+	cmds = append(cmds,
+		CreateDir(keys),
+		ShellCommand{
+			Label: "Create Secure Boot keys in " + keys,
+			Cmd:   fmt.Sprintf("sbctl create-keys --database-path %s/GUID --export %s/keys", keys, keys),
+		},
+	)
+
+	return
+}
+
+func SecureBootEnrollCommands(conf configuration.Conf) (cmds []Command) {
+	if !conf.SecureBoot {
+		return
+	}
+
+	if !conf.EnrollKeys {
+		return
+	}
+
+	cmds = append(cmds, BindMount(filepath.Join("/mnt", SECUREBOOTDIR), SBCTLKEYDIR)...)
+	cmds = append(cmds,
+		ShellCommand{
+			Label: "Check that the firmware is in setup mode",
+			Cmd:   `sbctl status --json | grep -Eq '"setup_mode": ?true' || { echo "The firmware is not in setup mode" >&2; false; }`,
+		},
+		ShellCommand{
+			Label: "Enroll the Secure Boot keys with Microsoft's keys",
+			Cmd:   "sbctl enroll-keys --microsoft",
+		},
+		Unmount(SBCTLKEYDIR),
+	)
+
+	return
+}
+
+// SecureBootNotes are what is left to do after the first boot
+func SecureBootNotes(conf configuration.Conf) (notes []string) {
+	if !conf.SecureBoot {
+		return
+	}
+
+	if pcrs, err := conf.EnrolledTPM2PCRs(); conf.TPM2 && err == nil && pcrs != conf.TPM2PCRs {
+		notes = append(notes, fmt.Sprintf("The TPM2 key is bound to PCRs %s only, rebind it to %s after the first boot with: systemd-cryptenroll --wipe-slot=tpm2 --tpm2-device=auto --tpm2-pcrs=%s <partition>", pcrs, conf.TPM2PCRs, conf.TPM2PCRs))
+	}
+	if !conf.EnrollKeys {
+		notes = append(notes, "The Secure Boot keys aren't enrolled, enroll them with sbctl after putting the firmware into setup mode")
+	}
+
+	return
+}
+
+// SecureBootNixExpression replaces systemd-boot, sbctl is added to the packages separately
+func SecureBootNixExpression() string {
+	return fmt.Sprintf(`boot.loader.systemd-boot.enable = false;
+  boot.lanzaboote = {
+    enable = true;
+    pkiBundle = %q;
+  };`, SECUREBOOTDIR)
+}
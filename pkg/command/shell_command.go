@@ -1,11 +1,9 @@
 package command
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"os"
-	"os/exec"
+	"regexp"
 	"strings"
 
 	"github.com/Meerschwein/nixos-go-up/pkg/util"
@@ -16,81 +14,148 @@ type ShellCommand struct {
 	Cmd               string
 	OutLabel          string
 	InputPreprocessor func(string) string
+	Secrets           []Secret
+	// Sensitive output is captured but not echoed
+	Sensitive bool
+	Policy    Policy
 }
 
 func (c ShellCommand) Message() string {
 	return c.Label
 }
 
-func (c ShellCommand) Execute(state map[string]string) (key string, val string, err error) {
-	for k, v := range state {
+// stateRef is a reference to a variable like $NAME or ${NAME}
+var stateRef = regexp.MustCompile(`\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+
+func (c ShellCommand) Execute(ctx context.Context, executor Executor, state map[string]string) (key string, val string, err error) {
+	// Only whole names are replaced, $NAME_2 isn't $NAME followed by _2
+	c.Cmd = stateRef.ReplaceAllStringFunc(c.Cmd, func(ref string) string {
+		m := stateRef.FindStringSubmatch(ref)
+		name := m[1] + m[2]
+		v, ok := state[name]
+		if !ok || c.isSecret(name) {
+			return ref
+		}
+		// Like a command substitution in scripts
+		v = strings.TrimRight(v, "\n")
 		if c.InputPreprocessor != nil {
 			v = c.InputPreprocessor(v)
 		}
-		c.Cmd = strings.ReplaceAll(c.Cmd, "$"+k, v)
-	}
-
-	fmt.Println(c.Cmd)
+		return v
+	})
 
-	var out bytes.Buffer
-	exec := exec.Command("bash", "-c", c.Cmd)
-
-	exec.Stdout = io.MultiWriter(os.Stdout, &out)
-	exec.Stderr = io.MultiWriter(os.Stderr, &out)
+	secrets := []Secret{}
+	for _, s := range c.Secrets {
+		s.Value = s.resolve(state)
+		secrets = append(secrets, s)
+	}
 
-	err = exec.Run()
-	val = out.String()
+	val, err = executor.Run(ctx, Run{
+		Label:     c.Label,
+		Cmd:       c.Cmd,
+		Secrets:   secrets,
+		Sensitive: c.Sensitive,
+	})
 	key = c.OutLabel
 
 	return
 }
 
+func (c ShellCommand) isSecret(name string) bool {
+	for _, s := range c.Secrets {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (c ShellCommand) ToShellCommand() (cmd string) {
 	cmd = c.Cmd
+	if c.Policy.Timeout > 0 {
+		cmd = c.timeoutShell()
+	}
 	if c.OutLabel != "" {
-		cmd = fmt.Sprintf("%s=$(%s)", c.OutLabel, c.Cmd)
+		cmd = fmt.Sprintf("%s=$(%s)", c.OutLabel, cmd)
 	}
 	return
 }
 
-func Sleep(secs int) Command {
-	return ShellCommand{
-		Label: fmt.Sprintf("Sleep for %d seconds", secs),
-		Cmd:   fmt.Sprintf("sleep %ds", secs),
+// timeoutShell runs the command in its own bash under timeout,
+// only the secrets and exported variables are visible to it
+func (c ShellCommand) timeoutShell() string {
+	words := []string{}
+	for _, s := range c.Secrets {
+		words = append(words, fmt.Sprintf(`%s="${%s}"`, s.Name, s.Name))
 	}
+	words = append(words, c.Policy.timeoutPrefix()+"bash -c "+util.ShellQuote(c.Cmd))
+	return strings.Join(words, " ")
 }
 
 func CreateDir(dir string) Command {
-	return ShellCommand{
-		Label: fmt.Sprintf("Create %s if it doesn't already exist", dir),
-		Cmd:   fmt.Sprintf("mkdir -p %s", dir),
+	return ExecCommand{
+		Label:   fmt.Sprintf("Create %s if it doesn't already exist", dir),
+		Program: "mkdir",
+		Args:    []string{"-p", dir},
+	}
+}
+
+func MountDir(from, to string, options ...string) []Command {
+	return []Command{
+		CreateDir(to),
+		ExecCommand{
+			Label:   fmt.Sprintf("Mounting %s to %s", from, to),
+			Program: "mount",
+			Args:    append(mountOptionsArgs(options), from, to),
+		},
+	}
+}
+
+func MountByLabel(label, to string, options ...string) []Command {
+	return []Command{
+		CreateDir(to),
+		ExecCommand{
+			Label:   fmt.Sprintf("Mounting %s to %s", label, to),
+			Program: "mount",
+			Args:    append(mountOptionsArgs(options), "-L", label, to),
+		},
 	}
 }
 
-func MountDir(from, to string) []Command {
+func MountTmpfs(to string, options ...string) []Command {
 	return []Command{
 		CreateDir(to),
-		ShellCommand{
-			Label: fmt.Sprintf("Mounting %s to %s", from, to),
-			Cmd:   fmt.Sprintf("mount %s %s", from, to),
+		ExecCommand{
+			Label:   "Mounting tmpfs to " + to,
+			Program: "mount",
+			Args:    append(append([]string{"-t", "tmpfs"}, mountOptionsArgs(options)...), "none", to),
 		},
 	}
 }
 
-func MountByLabel(label, to string) []Command {
+func BindMount(from, to string) []Command {
 	return []Command{
 		CreateDir(to),
-		ShellCommand{
-			Label: fmt.Sprintf("Mounting %s to %s", label, to),
-			Cmd:   fmt.Sprintf("mount -L %s %s", label, to),
+		ExecCommand{
+			Label:   fmt.Sprintf("Bind mounting %s to %s", from, to),
+			Program: "mount",
+			Args:    []string{"--bind", from, to},
 		},
 	}
 }
 
+func mountOptionsArgs(options []string) []string {
+	if len(options) == 0 {
+		return nil
+	}
+	return []string{"-o", strings.Join(options, ",")}
+}
+
 func Unmount(dir string) Command {
-	return ShellCommand{
-		Label: "Unmounting " + dir,
-		Cmd:   "umount " + dir,
+	return ExecCommand{
+		Label:   "Unmounting " + dir,
+		Program: "umount",
+		Args:    []string{dir},
 	}
 }
 
@@ -101,6 +166,36 @@ func WriteToFile(label, s, file string) Command {
 	}
 }
 
+// StateValue is the output of a previous command which isn't secret,
+// commands reference it like a variable of a script
+type StateValue string
+
+func (v StateValue) Ref() string {
+	return "$" + string(v)
+}
+
+// Placeholder marks where the value goes in file contents, see WriteSecretsToFile
+func (v StateValue) Placeholder() string {
+	return "@" + string(v) + "@"
+}
+
+// WriteSecretsToFile replaces the placeholders of the state values and secrets in s with references to them
+func WriteSecretsToFile(label, s, file string, values []StateValue, secrets ...Secret) Command {
+	s = util.EscapeBashDoubleQuotes(s)
+	for _, v := range values {
+		s = strings.ReplaceAll(s, v.Placeholder(), v.Ref())
+	}
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret.Placeholder(), "${"+secret.Name+"}")
+	}
+
+	return ShellCommand{
+		Label:   label,
+		Secrets: secrets,
+		Cmd:     fmt.Sprintf(`echo "%s" > %s`, s, file),
+	}
+}
+
 func AppendToFile(label, s, file string) Command {
 	return ShellCommand{
 		Label: label,
@@ -0,0 +1,76 @@
+package command
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+// PHASETEARDOWN cleans up after a failed or interrupted installation
+const PHASETEARDOWN = "teardown"
+
+// TeardownCommands unmount everything the installation mounted and deactivate
+// whatever is stacked on the disk, so the next attempt starts from a clean state.
+// Without a disk only the mounts are taken care of.
+func TeardownCommands(diskName string) (cmds []Command) {
+	cmds = append(cmds, ShellCommand{
+		Label: "Unmount everything below /mnt in reverse order",
+		Cmd:   forEachLine("findmnt -R -rn -o TARGET /mnt | tac", "target", `umount "$target"`),
+	})
+
+	// Temporary mounts outside of /mnt, see FormatAndEncryptPartitionWithYubikey and SecureBootEnrollCommands
+	for _, dir := range []string{"/root/boot", SBCTLKEYDIR} {
+		cmds = append(cmds, ShellCommand{
+			Label: fmt.Sprintf("Unmount %s if it's still mounted", dir),
+			Cmd:   fmt.Sprintf("if mountpoint -q %[1]s; then umount %[1]s; fi", dir),
+		})
+	}
+
+	if diskName == "" {
+		return
+	}
+
+	dev := util.ShellQuote("/dev/" + diskName)
+
+	cmds = append(cmds,
+		ShellCommand{
+			Label: "Deactivate swap on " + diskName,
+			Cmd: forEachLine(
+				fmt.Sprintf(`lsblk -nrpo NAME,MOUNTPOINT %s | awk '$2 == "[SWAP]" { print $1 }'`, dev),
+				"name",
+				`swapoff "$name"`,
+			),
+		},
+		// lsblk lists the devices stacked on the disk after the ones below them
+		ShellCommand{
+			Label: "Close LUKS mappings and deactivate LVM and RAID devices on " + diskName,
+			Cmd: forEachLine(
+				fmt.Sprintf(`lsblk -nrpo NAME,TYPE %s | tac | awk '!seen[$1]++'`, dev),
+				"name type",
+				`case "$type" in crypt) cryptsetup close "$name" ;; lvm) lvchange -an "$name" ;; raid*) mdadm --stop "$name" ;; esac`,
+			),
+		},
+	)
+
+	return
+}
+
+// forEachLine runs action for every line of list and fails if any of them failed
+func forEachLine(list, vars, action string) string {
+	return fmt.Sprintf("%s | { status=0; while read -r %s; do %s || status=1; done; exit $status; }", list, vars, action)
+}
+
+// Teardown runs all teardown commands even if some of them fail and returns the first error
+func Teardown(ctx context.Context, runner Runner, diskName string) (err error) {
+	cmds := TeardownCommands(diskName)
+
+	runner.Done = nil
+	runner.Phases = []string{PHASETEARDOWN}
+	for _, cmd := range cmds {
+		if cmdErr := runner.Run(ctx, []Command{cmd}, map[string]string{}); cmdErr != nil && err == nil {
+			err = cmdErr
+		}
+	}
+	return
+}
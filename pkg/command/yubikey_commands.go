@@ -0,0 +1,73 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+func YubikeySetupCommands(conf configuration.Conf) (cmds []Command) {
+	if !conf.Disk.Encrypt || !conf.Yubikey {
+		return
+	}
+
+	// Challenging both keys with the same value proves they share the secret
+	challenge := util.RandomHex(32)
+
+	if conf.YubikeyBackup {
+		cmds = append(cmds, WaitForYubikey("primary")...)
+	}
+
+	if conf.YubikeySecret != "" {
+		cmds = append(cmds, ProgramYubikey(conf.YubikeySlot, conf.YubikeySecret))
+	}
+
+	if !conf.YubikeyBackup {
+		return
+	}
+
+	cmds = append(cmds, ShellCommand{
+		Label:    "Challenge the primary Yubikey",
+		Cmd:      fmt.Sprintf("ykchalresp -%d -x %s 2>/dev/null", conf.YubikeySlot, challenge),
+		OutLabel: "YUBI_CHECK",
+	})
+	cmds = append(cmds, WaitForYubikey("backup")...)
+	cmds = append(cmds,
+		ProgramYubikey(conf.YubikeySlot, conf.YubikeySecret),
+		ShellCommand{
+			Label:             "Check that the backup Yubikey responds like the primary one",
+			InputPreprocessor: util.RemoveLinebreaks,
+			Cmd:               fmt.Sprintf(`test "$(ykchalresp -%d -x %s 2>/dev/null)" = "$YUBI_CHECK"`, conf.YubikeySlot, challenge),
+		},
+	)
+	cmds = append(cmds, WaitForYubikey("primary")...)
+
+	return
+}
+
+func WaitForYubikey(which string) []Command {
+	return []Command{
+		PromptCommand{
+			Label:  fmt.Sprintf("Wait for the %s Yubikey", which),
+			Prompt: fmt.Sprintf("Plug in only the %s Yubikey", which),
+		},
+		ExecCommand{
+			Label:   fmt.Sprintf("Check that the %s Yubikey is plugged in", which),
+			Program: "ykinfo",
+			Args:    []string{"-s"},
+		},
+	}
+}
+
+// ProgramYubikey passes the secret on stdin, ykpersonalize asks for it with a bare -a
+func ProgramYubikey(slot int, secret string) Command {
+	hmac := YubikeySecret(secret)
+
+	return ExecCommand{
+		Label:   fmt.Sprintf("Program slot %d for HMAC-SHA1 challenge response", slot),
+		Program: "ykpersonalize",
+		Args:    []string{fmt.Sprintf("-%d", slot), "-y", "-a", "-ochal-resp", "-ochal-hmac", "-ohmac-lt64", "-oserial-api-visible"},
+		Stdin:   &hmac,
+	}
+}
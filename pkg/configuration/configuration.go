@@ -2,6 +2,7 @@ package configuration
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -16,11 +17,39 @@ type Conf struct {
 	Password          string
 	DesktopEnviroment DesktopEnviroment
 	KeyboardLayout    string
+	Layout            Layout
 
 	Firmware      Firmware
 	NetInterfaces []string
 	Yubikey       bool
 	YubikeySlot   int
+	// YubikeySecret is the HMAC-SHA1 secret to program, a backup key needs the same one
+	YubikeySecret string
+	YubikeyBackup bool
+	// YubikeySalt derives the challenge, it's fixed here so a resumed installation can reopen the disk
+	YubikeySalt string
+	TPM2        bool
+	TPM2Device  string
+	TPM2PCRs    string
+	FIDO2Keys   int
+
+	// RecoveryEscrow is a file outside the target disk to store the recovery passphrase in
+	RecoveryEscrow string
+	// HeaderBackupDir receives a backup of every LUKS header
+	HeaderBackupDir string
+
+	SecureBoot          bool
+	SecureBootSetupMode bool
+	EnrollKeys          bool
+
+	// HooksDir holds the executables run at the hook points
+	HooksDir string
+	// RootSizeGB limits the root partition, the rest of the disk is left free for hooks.
+	// It fills the disk if 0.
+	RootSizeGB int
+
+	// MountOptions maps a mountpoint like "/" or "/boot" to its mount options
+	MountOptions map[string][]string
 }
 
 func (c Conf) String() (res string) {
@@ -28,23 +57,125 @@ func (c Conf) String() (res string) {
 	if c.Yubikey {
 		encrypt += " with Yubikey"
 	}
+	if c.YubikeySecret != "" {
+		encrypt += fmt.Sprintf(" (programming slot %d)", c.YubikeySlot)
+	}
+	if c.YubikeyBackup {
+		encrypt += " and backup Yubikey"
+	}
+	if c.TPM2 {
+		pcrs, err := c.EnrolledTPM2PCRs()
+		if err != nil {
+			pcrs = err.Error()
+		}
+		encrypt += " with TPM2 (PCRs " + pcrs + ")"
+	}
+	if c.FIDO2Keys > 0 {
+		encrypt += fmt.Sprintf(" with %d FIDO2 key(s)", c.FIDO2Keys)
+	}
+	if c.Disk.Encrypt {
+		encrypt += " (" + c.LuksParams().String() + ")"
+	}
+	if c.Disk.RecoveryPasswd != "" {
+		encrypt += ", recovery passphrase escrowed to " + c.RecoveryEscrow
+	}
+	if c.Disk.DetachedHeader != "" {
+		encrypt += ", header on " + c.Disk.DetachedHeader
+	}
+	if c.HeaderBackupDir != "" {
+		encrypt += ", header backup to " + c.HeaderBackupDir
+	}
+	if c.EncryptedBoot() {
+		encrypt += ", encrypted /boot and initrd keyfile"
+	}
 
 	return fmt.Sprintf(`
 Disk:         %s
 Encyrpt disk: %v
+Layout:       %s
+Secure Boot:  %s
 Hostname:     %s
 Timezone:     %s
 Desktop:      %s
 Keyboard:     %s
 Username:     %s
-Password:     %s`,
-		c.Disk.Name,
+Password:     %s
+Mounts:       %s`,
+		c.diskString(),
 		encrypt,
+		c.Layout,
+		c.secureBootString(),
 		c.Hostname,
 		c.Timezone,
 		c.DesktopEnviroment,
 		c.KeyboardLayout,
 		c.Username,
 		strings.Repeat("*", len(c.Password)),
+		c.mountOptionsString(),
 	)
 }
+
+func (c Conf) diskString() string {
+	if c.RootSizeGB == 0 {
+		return c.Disk.Name
+	}
+	return fmt.Sprintf("%s, root partition %dGB", c.Disk.Name, c.RootSizeGB)
+}
+
+func (c Conf) secureBootString() string {
+	switch {
+	case !c.SecureBoot:
+		return "false"
+	case c.EnrollKeys:
+		return "true, enrolling keys"
+	case c.SecureBootSetupMode:
+		return "true, keys not enrolled"
+	default:
+		return "true, firmware not in setup mode"
+	}
+}
+
+// SECUREBOOTPCR measures the Secure Boot state and keys
+const SECUREBOOTPCR = "7"
+
+// EnrolledTPM2PCRs are the PCRs the TPM2 key is bound to. The Secure Boot keys
+// are enrolled after the disk is set up, which changes PCR 7, so it's left out then.
+// Without any other PCR the key would unlock the disk on every machine state.
+func (c Conf) EnrolledTPM2PCRs() (string, error) {
+	if !c.SecureBoot {
+		return c.TPM2PCRs, nil
+	}
+
+	pcrs := []string{}
+	for _, pcr := range strings.Split(c.TPM2PCRs, "+") {
+		if pcr != "" && pcr != SECUREBOOTPCR {
+			pcrs = append(pcrs, pcr)
+		}
+	}
+	if len(pcrs) == 0 {
+		return "", fmt.Errorf("enrolling the Secure Boot keys changes PCR %s, the TPM2 key has to be bound to another PCR as well", SECUREBOOTPCR)
+	}
+	return strings.Join(pcrs, "+"), nil
+}
+
+func (c Conf) mountOptionsString() string {
+	mountpoints := []string{}
+	for mp := range c.MountOptions {
+		mountpoints = append(mountpoints, mp)
+	}
+	sort.Strings(mountpoints)
+
+	res := []string{}
+	for _, mp := range mountpoints {
+		if len(c.MountOptions[mp]) == 0 {
+			continue
+		}
+		res = append(res, fmt.Sprintf("%s (%s)", mp, strings.Join(c.MountOptions[mp], ",")))
+	}
+
+	if len(res) == 0 {
+		return "defaults"
+	}
+
+	return strings.Join(res, " ")
+}
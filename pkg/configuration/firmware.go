@@ -1,6 +1,9 @@
 package configuration
 
-import "github.com/Meerschwein/nixos-go-up/pkg/util"
+import (
+	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
 
 type Firmware string
 
@@ -22,3 +25,45 @@ func (c Conf) SetFirmware() Conf {
 func (c Conf) IsUEFI() bool {
 	return c.Firmware == UEFI
 }
+
+// HasBootPartition is true when /boot or the ESP is a partition of its own, BIOS only
+// needs one to keep /boot readable for GRUB on encrypted disks and off the tmpfs root
+func (c Conf) HasBootPartition() bool {
+	return c.IsUEFI() || (c.Disk.Encrypt && !c.EncryptedBoot()) || c.IsImpermanent()
+}
+
+// CanEncryptBoot is true when only the password unlocks the disk, GRUB can't
+// use tokens or detached headers and lanzaboote needs an unencrypted ESP at /boot
+func (c Conf) CanEncryptBoot() bool {
+	return c.Disk.Encrypt && !c.Yubikey && !c.TPM2 && c.FIDO2Keys == 0 &&
+		c.Disk.DetachedHeader == "" && !c.SecureBoot && !c.IsImpermanent()
+}
+
+// EncryptedBoot keeps /boot on the encrypted root, GRUB asks for the password
+// and the initrd unlocks the root again with a keyfile that never leaves it
+func (c Conf) EncryptedBoot() bool {
+	return c.Disk.InitrdKeyfile && c.CanEncryptBoot()
+}
+
+// BootMountpoint is where the boot partition is mounted, the ESP moves
+// below /boot when /boot is encrypted
+func (c Conf) BootMountpoint() string {
+	if c.EncryptedBoot() {
+		return "/boot/efi"
+	}
+	return "/boot"
+}
+
+// LuksParams are the parameters the partitions are encrypted with,
+// GRUB only unlocks PBKDF2 keyslots
+func (c Conf) LuksParams() disk.LuksParams {
+	luks := c.Disk.LUKS
+	if luks == (disk.LuksParams{}) {
+		luks = disk.DefaultLuksParams()
+	}
+	if c.EncryptedBoot() {
+		luks.PBKDF = "pbkdf2"
+		luks.MemoryKiB = 0
+	}
+	return luks
+}
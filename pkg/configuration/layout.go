@@ -0,0 +1,48 @@
+package configuration
+
+type Layout string
+
+const (
+	Standard     Layout = "standard"
+	Impermanence Layout = "impermanence"
+)
+
+func Layouts() []Layout {
+	return []Layout{Standard, Impermanence}
+}
+
+// PersistDirectories are kept across reboots in the impermanence layout
+func (c Conf) PersistDirectories() []string {
+	dirs := []string{
+		"/etc/nixos",
+		"/etc/NetworkManager/system-connections",
+		"/var/log",
+		"/var/lib/nixos",
+		"/var/lib/systemd/coredump",
+	}
+
+	if c.SecureBoot {
+		dirs = append(dirs, "/etc/secureboot")
+	}
+
+	return dirs
+}
+
+// PersistFiles are kept across reboots in the impermanence layout
+func PersistFiles() []string {
+	return []string{
+		"/etc/machine-id",
+	}
+}
+
+func (c Conf) IsImpermanent() bool {
+	return c.Layout == Impermanence
+}
+
+// RootMountpoint is where the root partition of the disk gets mounted
+func (c Conf) RootMountpoint() string {
+	if c.IsImpermanent() {
+		return "/nix"
+	}
+	return "/"
+}
@@ -3,6 +3,7 @@ package disk
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -28,6 +29,12 @@ type Disk struct {
 	SizeGB           int
 	Encrypt          bool
 	EncryptionPasswd string
+	LUKS             LuksParams
+	RecoveryPasswd   string
+	DetachedHeader   string
+	InitrdKeyfile    bool // /boot is encrypted and the initrd unlocks the root with a keyfile
+	SSD              bool
+	Discard          bool // TRIM for filesystems and LUKS, defaults to SSD
 
 	PartitionTable PartitionTable
 	Partitions     []Partition
@@ -36,14 +43,18 @@ type Disk struct {
 }
 
 type Partition struct {
-	Label    string
-	Path     string
-	Format   Filesystem
-	Primary  bool
-	Bootable bool
-	Number   int
-	From     string
-	To       string
+	Label         string
+	Path          string
+	Format        Filesystem
+	FormatOptions []string
+	Primary       bool
+	Bootable      bool
+	Number        int
+	From          string
+	To            string
+	Mountpoint    string
+	MountOptions  []string
+	LuksHeader    string
 }
 
 func (d Disk) WithSize() Disk {
@@ -59,6 +70,13 @@ func (d Disk) WithSize() Disk {
 	return d
 }
 
+func (d Disk) WithRotational() Disk {
+	d.SSD = util.GetFirstLineOfFile("/sys/block/"+d.Name+"/queue/rotational") == "0"
+	d.Discard = d.SSD
+
+	return d
+}
+
 func GetDisks() (disks []Disk) {
 	devices, err := ioutil.ReadDir("/sys/block")
 	util.ExitIfErr(err)
@@ -70,7 +88,7 @@ func GetDisks() (disks []Disk) {
 
 		d := Disk{Name: device.Name()}
 
-		disks = append(disks, d.WithSize())
+		disks = append(disks, d.WithSize().WithRotational())
 	}
 
 	return
@@ -85,11 +103,17 @@ func DisplayDisks(disks []Disk) (display []string) {
 	}
 
 	for _, d := range disks {
+		kind := "HDD"
+		if d.SSD {
+			kind = "SSD"
+		}
+
 		display = append(display,
-			fmt.Sprintf("%s%s %dGb",
+			fmt.Sprintf("%s%s %dGb %s",
 				d.Name,
 				strings.Repeat(" ", longestNameLength-len(d.Name)),
 				d.SizeGB,
+				kind,
 			),
 		)
 	}
@@ -115,3 +139,25 @@ func (d Disk) GetRootPartition() Partition {
 func (d Disk) GetBootPartition() Partition {
 	return d.Partitions[d.BootPartition]
 }
+
+// MountedPartitions returns all partitions with a mountpoint, parents before children
+func (d Disk) MountedPartitions() (parts []Partition) {
+	for _, p := range d.Partitions {
+		if p.Mountpoint != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	sort.SliceStable(parts, func(i, j int) bool {
+		return mountDepth(parts[i].Mountpoint) < mountDepth(parts[j].Mountpoint)
+	})
+
+	return
+}
+
+func mountDepth(mountpoint string) int {
+	if mountpoint == "/" {
+		return 0
+	}
+	return strings.Count(strings.TrimSuffix(mountpoint, "/"), "/")
+}
@@ -0,0 +1,156 @@
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Existing is a partition or anything else found on a disk before it is wiped
+type Existing struct {
+	Name      string
+	Type      string
+	SizeBytes int64
+	FSType    string
+	Label     string
+	Depth     int
+}
+
+type lsblkDevice struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Size     json.RawMessage `json:"size"`
+	FSType   *string         `json:"fstype"`
+	Label    *string         `json:"label"`
+	Children []lsblkDevice   `json:"children"`
+}
+
+// ExistingData lists everything on the disk which will be destroyed
+func ExistingData(name string) ([]Existing, error) {
+	out, err := exec.Command("lsblk", "-J", "-b", "-o", "NAME,TYPE,SIZE,FSTYPE,LABEL", "/dev/"+name).Output()
+	if err != nil {
+		return nil, err
+	}
+	return ParseLsblk(out)
+}
+
+// ParseLsblk parses the output of lsblk -J -b without the disk itself
+func ParseLsblk(data []byte) (existing []Existing, err error) {
+	var out struct {
+		Blockdevices []lsblkDevice `json:"blockdevices"`
+	}
+	if err = json.Unmarshal(data, &out); err != nil {
+		return
+	}
+
+	var walk func(devices []lsblkDevice, depth int)
+	walk = func(devices []lsblkDevice, depth int) {
+		for _, d := range devices {
+			e := Existing{
+				Name:  d.Name,
+				Type:  d.Type,
+				Depth: depth,
+			}
+			// Older versions of lsblk print the size as string
+			e.SizeBytes, _ = strconv.ParseInt(strings.Trim(string(d.Size), `"`), 10, 64)
+			if d.FSType != nil {
+				e.FSType = *d.FSType
+			}
+			if d.Label != nil {
+				e.Label = *d.Label
+			}
+			existing = append(existing, e)
+			walk(d.Children, depth+1)
+		}
+	}
+
+	for _, d := range out.Blockdevices {
+		walk(d.Children, 0)
+	}
+
+	return
+}
+
+// HumanSize formats sizes like lsblk does
+func HumanSize(bytes int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(bytes)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 || size >= 100 {
+		return fmt.Sprintf("%.0f %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+// SizeMiB is the offset of a parted position like "512MiB" or "100%",
+// percentages need the size of the disk
+func (d Disk) SizeMiB(position string) (float64, bool) {
+	units := map[string]float64{"MiB": 1, "GiB": 1024, "TiB": 1024 * 1024, "%": float64(d.SizeGB) * 1024 / 100}
+	for unit, factor := range units {
+		if !strings.HasSuffix(position, unit) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(position, unit), 64)
+		if err != nil || factor == 0 {
+			return 0, false
+		}
+		return n * factor, true
+	}
+	return 0, false
+}
+
+// Identity recognizes a disk again, its name alone can change between boots
+type Identity struct {
+	Name      string `json:"name"`
+	Serial    string `json:"serial"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+func Identify(name string) (id Identity, err error) {
+	out, err := exec.Command("lsblk", "-J", "-b", "-d", "-o", "NAME,SERIAL,SIZE", "/dev/"+name).Output()
+	if err != nil {
+		return
+	}
+
+	var devices struct {
+		Blockdevices []struct {
+			Name   string          `json:"name"`
+			Serial *string         `json:"serial"`
+			Size   json.RawMessage `json:"size"`
+		} `json:"blockdevices"`
+	}
+	if err = json.Unmarshal(out, &devices); err != nil {
+		return
+	}
+	if len(devices.Blockdevices) != 1 {
+		return id, fmt.Errorf("lsblk didn't find /dev/%s", name)
+	}
+
+	d := devices.Blockdevices[0]
+	id.Name = d.Name
+	if d.Serial != nil {
+		id.Serial = *d.Serial
+	}
+	id.SizeBytes, err = strconv.ParseInt(strings.Trim(string(d.Size), `"`), 10, 64)
+
+	return
+}
+
+// Verify fails if the disk with the name isn't the identified one anymore
+func (id Identity) Verify() error {
+	current, err := Identify(id.Name)
+	if err != nil {
+		return err
+	}
+	if current != id {
+		return fmt.Errorf("/dev/%s changed: serial %q size %d, expected serial %q size %d",
+			id.Name, current.Serial, current.SizeBytes, id.Serial, id.SizeBytes)
+	}
+	return nil
+}
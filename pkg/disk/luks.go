@@ -0,0 +1,161 @@
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
+)
+
+const (
+	MaxArgon2MemoryKiB = 1048576
+	MinArgon2MemoryKiB = 65536
+)
+
+type LuksParams struct {
+	Cipher      string
+	KeySize     int
+	Hash        string
+	PBKDF       string
+	IterTimeMs  int
+	MemoryKiB   int
+	Benchmarked bool
+}
+
+type CipherBenchmark struct {
+	Algorithm  string
+	KeySize    int
+	Encryption float64
+	Decryption float64
+}
+
+func DefaultLuksParams() LuksParams {
+	return LuksParams{
+		Cipher:     "aes-xts-plain64",
+		KeySize:    512,
+		Hash:       "sha512",
+		PBKDF:      "argon2id",
+		IterTimeMs: 5000,
+		MemoryKiB:  MaxArgon2MemoryKiB,
+	}
+}
+
+func PBKDFs() []string {
+	return []string{"argon2id", "argon2i", "pbkdf2"}
+}
+
+func (l LuksParams) IsArgon2() bool {
+	return strings.HasPrefix(l.PBKDF, "argon2")
+}
+
+// Args are the cryptsetup luksFormat arguments
+func (l LuksParams) Args() []string {
+	args := []string{
+		"--type", "luks2",
+		"--cipher", l.Cipher,
+		"--key-size", strconv.Itoa(l.KeySize),
+		"--hash", l.Hash,
+		"--pbkdf", l.PBKDF,
+		"--iter-time", strconv.Itoa(l.IterTimeMs),
+	}
+	if l.IsArgon2() && l.MemoryKiB > 0 {
+		args = append(args, "--pbkdf-memory", strconv.Itoa(l.MemoryKiB))
+	}
+	return args
+}
+
+func (l LuksParams) String() string {
+	res := fmt.Sprintf("%s %d bit, %s %dms", l.Cipher, l.KeySize, l.PBKDF, l.IterTimeMs)
+	if l.IsArgon2() {
+		res += fmt.Sprintf(" %dMiB", l.MemoryKiB/1024)
+	}
+	return res
+}
+
+// ParseCryptsetupBenchmark reads the cipher lines of `cryptsetup benchmark` like
+//
+//	aes-xts        512b      2345.6 MiB/s      2401.2 MiB/s
+func ParseCryptsetupBenchmark(out string) (benchmarks []CipherBenchmark) {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 || fields[3] != "MiB/s" || fields[5] != "MiB/s" {
+			continue
+		}
+
+		keySize, err := strconv.Atoi(strings.TrimSuffix(fields[1], "b"))
+		if err != nil {
+			continue
+		}
+		enc, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		dec, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			continue
+		}
+
+		benchmarks = append(benchmarks, CipherBenchmark{
+			Algorithm:  fields[0],
+			KeySize:    keySize,
+			Encryption: enc,
+			Decryption: dec,
+		})
+	}
+	return
+}
+
+// PickLuksParams chooses the fastest XTS cipher with the largest key and
+// as much argon2 memory as the machine can spare
+func PickLuksParams(benchmarks []CipherBenchmark, memAvailableKiB int) LuksParams {
+	params := DefaultLuksParams()
+
+	var best *CipherBenchmark
+	for i, b := range benchmarks {
+		if !strings.HasSuffix(b.Algorithm, "-xts") {
+			continue
+		}
+		if best == nil ||
+			b.Decryption > best.Decryption ||
+			(b.Decryption == best.Decryption && b.KeySize > best.KeySize) {
+			best = &benchmarks[i]
+		}
+	}
+
+	if best != nil {
+		params.Cipher = best.Algorithm + "-plain64"
+		params.KeySize = best.KeySize
+		// A 512 bit key is barely slower than a 256 bit one for XTS
+		for _, b := range benchmarks {
+			if b.Algorithm == best.Algorithm && b.KeySize > params.KeySize && b.Decryption >= best.Decryption*0.8 {
+				params.KeySize = b.KeySize
+			}
+		}
+		params.Benchmarked = true
+	}
+
+	if memAvailableKiB > 0 {
+		params.MemoryKiB = memAvailableKiB / 4
+		if params.MemoryKiB > MaxArgon2MemoryKiB {
+			params.MemoryKiB = MaxArgon2MemoryKiB
+		}
+		if params.MemoryKiB < MinArgon2MemoryKiB {
+			params.MemoryKiB = MinArgon2MemoryKiB
+		}
+	}
+
+	return params
+}
+
+func BenchmarkLuksParams() LuksParams {
+	out, err := exec.Command("cryptsetup", "benchmark").Output()
+	if err != nil {
+		return PickLuksParams(nil, util.GetAvailableMemoryKiB())
+	}
+
+	return PickLuksParams(ParseCryptsetupBenchmark(string(out)), util.GetAvailableMemoryKiB())
+}
@@ -0,0 +1,64 @@
+package disk_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+	"github.com/Meerschwein/nixos-go-up/test/generators"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"pgregory.net/rapid"
+)
+
+const benchmarkOutput = `# Tests are approximate using memory only (no storage IO).
+PBKDF2-sha1      1638400 iterations per second for 256-bit key
+PBKDF2-sha256    2933079 iterations per second for 256-bit key
+argon2id      8 iterations, 1048576 memory, 4 parallel threads (CPUs) for 256-bit key (requested 2000 ms time)
+#     Algorithm |       Key |      Encryption |      Decryption
+        aes-cbc        128b      1215.4 MiB/s      3892.1 MiB/s
+    serpent-cbc        128b       105.2 MiB/s       758.2 MiB/s
+        aes-xts        256b      3517.7 MiB/s      3528.3 MiB/s
+    serpent-xts        256b       698.4 MiB/s       700.2 MiB/s
+        aes-xts        512b      3014.6 MiB/s      3011.0 MiB/s
+    serpent-xts        512b       704.0 MiB/s       699.9 MiB/s
+`
+
+func TestLuks_ParseCryptsetupBenchmark_Unit(t *testing.T) {
+	benchmarks := disk.ParseCryptsetupBenchmark(benchmarkOutput)
+
+	require.Len(t, benchmarks, 6)
+	assert.Equal(t, disk.CipherBenchmark{
+		Algorithm:  "aes-xts",
+		KeySize:    512,
+		Encryption: 3014.6,
+		Decryption: 3011.0,
+	}, benchmarks[4])
+}
+
+func TestLuks_PickLuksParams_Unit(t *testing.T) {
+	params := disk.PickLuksParams(disk.ParseCryptsetupBenchmark(benchmarkOutput), 8*1024*1024)
+
+	assert.Equal(t, "aes-xts-plain64", params.Cipher)
+	assert.Equal(t, 512, params.KeySize)
+	assert.Equal(t, disk.MaxArgon2MemoryKiB, params.MemoryKiB)
+	assert.True(t, params.Benchmarked)
+
+	params = disk.PickLuksParams(nil, 512*1024)
+
+	assert.Equal(t, disk.DefaultLuksParams().Cipher, params.Cipher)
+	assert.Equal(t, 128*1024, params.MemoryKiB)
+	assert.False(t, params.Benchmarked)
+}
+
+func TestLuks_Args_Properties(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		params := generators.LuksParams().Draw(t, "LuksParams").(disk.LuksParams)
+
+		args := strings.Join(params.Args(), " ")
+
+		require.Contains(t, args, "--cipher "+params.Cipher, "Cipher is passed")
+		require.Contains(t, args, "--pbkdf "+params.PBKDF, "PBKDF is passed")
+		require.Equal(t, params.IsArgon2(), strings.Contains(args, "--pbkdf-memory"), "Memory only for argon2")
+	})
+}
@@ -0,0 +1,202 @@
+// Package events drives the installer from a frontend with JSON lines,
+// events go out and answers to prompts come back in.
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	PROMPT  = "prompt"
+	INVALID = "invalid"
+	MESSAGE = "message"
+	LOG     = "log"
+	CONF    = "configuration"
+	PLAN    = "plan"
+	START   = "command_start"
+	FINISH  = "command_finish"
+	RESULT  = "result"
+)
+
+// Prompt kinds
+const (
+	TEXT    = "text"
+	SECRET  = "secret"
+	SELECT  = "select"
+	CONFIRM = "confirm"
+)
+
+// Event is a single JSON line, only the fields of its type are set
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Prompts, an answer has to repeat the ID
+	ID      int      `json:"id,omitempty"`
+	Kind    string   `json:"kind,omitempty"`
+	Label   string   `json:"label,omitempty"`
+	Default string   `json:"default,omitempty"`
+	Items   []string `json:"items,omitempty"`
+
+	// Messages and lines of command output, Stream is stdout or stderr
+	Message string `json:"message,omitempty"`
+	Stream  string `json:"stream,omitempty"`
+
+	Configuration interface{} `json:"configuration,omitempty"`
+	Plan          string      `json:"plan,omitempty"`
+	Sections      []Section   `json:"sections,omitempty"`
+
+	// Commands, Index counts from 0 up to Total
+	Index    *int    `json:"index,omitempty"`
+	Total    int     `json:"total,omitempty"`
+	Phase    string  `json:"phase,omitempty"`
+	Attempt  int     `json:"attempt,omitempty"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+	ExitCode *int    `json:"exit_code,omitempty"`
+	Progress float64 `json:"progress,omitempty"`
+
+	Success *bool  `json:"success,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Section is a group of steps of the plan
+type Section struct {
+	Name  string   `json:"name"`
+	Steps []string `json:"steps"`
+}
+
+// Answer to the prompt with the same ID, Value is for text and secrets,
+// Index for a selection and Confirm for a confirmation
+type Answer struct {
+	ID      int    `json:"id"`
+	Value   string `json:"value,omitempty"`
+	Index   int    `json:"index,omitempty"`
+	Confirm bool   `json:"confirm,omitempty"`
+	// Cancel aborts like Ctrl-C on a terminal
+	Cancel bool `json:"cancel,omitempty"`
+}
+
+type Stream struct {
+	mu     sync.Mutex
+	out    *json.Encoder
+	lastID int
+
+	// A single goroutine reads the answers so a cancelled prompt
+	// doesn't leave a reader behind which takes the next answer
+	in      *bufio.Scanner
+	read    sync.Once
+	answers chan []byte
+	inErr   error
+}
+
+func NewStream(w io.Writer, r io.Reader) *Stream {
+	return &Stream{out: json.NewEncoder(w), in: bufio.NewScanner(r), answers: make(chan []byte)}
+}
+
+// readAnswers hands out the lines of the input until it ends, inErr is set before closing
+func (s *Stream) readAnswers() {
+	for s.in.Scan() {
+		s.answers <- append([]byte(nil), s.in.Bytes()...)
+	}
+	s.inErr = s.in.Err()
+	if s.inErr == nil {
+		s.inErr = io.ErrUnexpectedEOF
+	}
+	close(s.answers)
+}
+
+func (s *Stream) Emit(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// Nothing sensible is left to do if the frontend went away
+	_ = s.out.Encode(e)
+}
+
+// Ask emits the prompt and waits for its answer until ctx is done,
+// answers to other prompts like a cancelled one are skipped
+func (s *Stream) Ask(ctx context.Context, prompt Event) (a Answer, err error) {
+	s.read.Do(func() { go s.readAnswers() })
+
+	s.mu.Lock()
+	s.lastID++
+	prompt.ID = s.lastID
+	s.mu.Unlock()
+
+	prompt.Type = PROMPT
+	s.Emit(prompt)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return a, ctx.Err()
+		case line, ok := <-s.answers:
+			if !ok {
+				return a, fmt.Errorf("no answer to %q: %w", prompt.Label, s.inErr)
+			}
+			a = Answer{}
+			if err := json.Unmarshal(line, &a); err != nil {
+				s.Emit(Event{Type: INVALID, ID: prompt.ID, Error: fmt.Sprintf("invalid answer: %v", err)})
+				continue
+			}
+			if a.ID == prompt.ID {
+				return a, nil
+			}
+		}
+	}
+}
+
+// Result is the last event, err is nil on success
+func (s *Stream) Result(err error) {
+	success := err == nil
+	e := Event{Type: RESULT, Success: &success}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.Emit(e)
+}
+
+// Writer emits every line written to it as an event of the type,
+// a log line is tagged with the stream
+func (s *Stream) Writer(typ, stream string) io.Writer {
+	return &lineWriter{emit: func(line string) {
+		if typ == MESSAGE && strings.TrimSpace(line) == "" {
+			return
+		}
+		s.Emit(Event{Type: typ, Stream: stream, Message: line})
+	}}
+}
+
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  []byte
+	emit func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
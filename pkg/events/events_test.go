@@ -0,0 +1,79 @@
+package events_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Meerschwein/nixos-go-up/pkg/events"
+	"github.com/stretchr/testify/require"
+)
+
+func decode(t *testing.T, out *bytes.Buffer) (es []events.Event) {
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e events.Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e), "Not a JSON line: %s", line)
+		es = append(es, e)
+	}
+	return
+}
+
+func TestStream_Ask(t *testing.T) {
+	out := &bytes.Buffer{}
+	answers := strings.NewReader("not json\n{\"id\": 7, \"value\": \"stale\"}\n{\"id\": 1, \"value\": \"nixos\"}\n")
+	stream := events.NewStream(out, answers)
+
+	a, err := stream.Ask(context.Background(), events.Event{Kind: events.TEXT, Label: "Hostname"})
+	require.NoError(t, err)
+	require.Equal(t, "nixos", a.Value, "The answer to another prompt was taken")
+
+	es := decode(t, out)
+	require.Equal(t, events.PROMPT, es[0].Type)
+	require.Equal(t, 1, es[0].ID)
+	require.Equal(t, events.INVALID, es[1].Type, "Garbage isn't reported")
+
+	_, err = stream.Ask(context.Background(), events.Event{Kind: events.TEXT, Label: "Username"})
+	require.Error(t, err, "A closed input isn't reported")
+}
+
+func TestStream_AskCancelled(t *testing.T) {
+	r, w := io.Pipe()
+	stream := events.NewStream(io.Discard, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := stream.Ask(ctx, events.Event{Kind: events.CONFIRM, Label: "Plug in the key"})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The late answer to the cancelled prompt arrives first
+	go fmt.Fprint(w, "{\"id\": 1, \"confirm\": true}\n{\"id\": 2, \"value\": \"nixos\"}\n")
+
+	a, err := stream.Ask(context.Background(), events.Event{Kind: events.TEXT, Label: "Hostname"})
+	require.NoError(t, err)
+	require.Equal(t, 2, a.ID, "The answer to the cancelled prompt was taken")
+	require.Equal(t, "nixos", a.Value)
+}
+
+func TestStream_Writer(t *testing.T) {
+	out := &bytes.Buffer{}
+	stream := events.NewStream(out, strings.NewReader(""))
+
+	w := stream.Writer(events.LOG, "stdout")
+	fmt.Fprint(w, "first li")
+	fmt.Fprint(w, "ne\r\nsecond line\nunfinished")
+	stream.Result(fmt.Errorf("failed"))
+
+	es := decode(t, out)
+	require.Len(t, es, 3, "Unfinished lines are emitted")
+	require.Equal(t, "first line", es[0].Message)
+	require.Equal(t, "stdout", es[0].Stream)
+	require.Equal(t, "second line", es[1].Message)
+	require.Equal(t, events.RESULT, es[2].Type)
+	require.False(t, *es[2].Success)
+	require.Equal(t, "failed", es[2].Error)
+}
@@ -1,12 +1,89 @@
 package selection
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 
+	"github.com/Meerschwein/nixos-go-up/pkg/events"
 	"github.com/Meerschwein/nixos-go-up/pkg/util"
 	"github.com/manifoldco/promptui"
 )
 
+// Events replaces the terminal prompts with prompt events when set
+var Events *events.Stream
+
+func runPrompt(prompt promptui.Prompt) (string, error) {
+	if Events == nil {
+		return prompt.Run()
+	}
+
+	e := events.Event{Kind: events.TEXT, Label: fmt.Sprint(prompt.Label), Default: prompt.Default}
+	switch {
+	case prompt.IsConfirm:
+		e.Kind = events.CONFIRM
+	case prompt.Mask != 0:
+		e.Kind = events.SECRET
+	}
+
+	for {
+		a, err := Events.Ask(context.Background(), e)
+		switch {
+		case err != nil:
+			return "", err
+		case a.Cancel:
+			return "", promptui.ErrInterrupt
+		case e.Kind == events.CONFIRM && !a.Confirm:
+			return "", promptui.ErrAbort
+		case e.Kind == events.CONFIRM:
+			return "y", nil
+		}
+
+		value := a.Value
+		if value == "" {
+			value = prompt.Default
+		}
+		if prompt.Validate != nil {
+			if err := prompt.Validate(value); err != nil {
+				Events.Emit(events.Event{Type: events.INVALID, ID: a.ID, Error: err.Error()})
+				continue
+			}
+		}
+		return value, nil
+	}
+}
+
+func runSelect(prompt promptui.Select) (int, string, error) {
+	if Events == nil {
+		return prompt.Run()
+	}
+
+	items := []string{}
+	list := reflect.ValueOf(prompt.Items)
+	for i := 0; i < list.Len(); i++ {
+		items = append(items, fmt.Sprint(list.Index(i).Interface()))
+	}
+
+	e := events.Event{Kind: events.SELECT, Label: fmt.Sprint(prompt.Label), Items: items}
+	if prompt.CursorPos < len(items) {
+		e.Default = items[prompt.CursorPos]
+	}
+
+	for {
+		a, err := Events.Ask(context.Background(), e)
+		switch {
+		case err != nil:
+			return 0, "", err
+		case a.Cancel:
+			return 0, "", promptui.ErrInterrupt
+		case a.Index < 0 || a.Index >= len(items):
+			Events.Emit(events.Event{Type: events.INVALID, ID: a.ID, Error: fmt.Sprintf("index %d is out of range", a.Index)})
+			continue
+		}
+		return a.Index, items[a.Index], nil
+	}
+}
+
 func SecretDialog(label string) (secret string) {
 	prompt := promptui.Prompt{
 		HideEntered: true,
@@ -17,15 +94,20 @@ func SecretDialog(label string) (secret string) {
 	check := "*"
 	for secret != check {
 		prompt.Label = "Choose " + label
-		secret, err = prompt.Run()
+		secret, err = runPrompt(prompt)
 		util.ExitIfErr(err)
 
+		// A frontend makes sure of the secret itself
+		if Events != nil {
+			return
+		}
+
 		prompt.Label = "Repeat " + label
-		check, err = prompt.Run()
+		check, err = runPrompt(prompt)
 		util.ExitIfErr(err)
 
 		if secret != check {
-			fmt.Println("Secrets don't match! Try again!")
+			fmt.Fprintln(util.Out, "Secrets don't match! Try again!")
 		}
 	}
 
@@ -38,7 +120,7 @@ func ConfirmationDialog(label string) (success bool) {
 		IsConfirm: true,
 	}
 
-	_, err := prompt.Run()
+	_, err := runPrompt(prompt)
 
 	success = err == nil
 
@@ -52,7 +134,7 @@ func YesNoDialog(label string) (success bool) {
 		Size:  2,
 	}
 
-	i, _, err := prompt.Run()
+	i, _, err := runSelect(prompt)
 	util.ExitIfErr(err)
 
 	success = i == 0
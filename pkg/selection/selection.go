@@ -2,11 +2,15 @@ package selection
 
 import (
 	"fmt"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Meerschwein/nixos-go-up/pkg/configuration"
 	"github.com/Meerschwein/nixos-go-up/pkg/disk"
+	"github.com/Meerschwein/nixos-go-up/pkg/util"
 	"github.com/manifoldco/promptui"
 )
 
@@ -21,7 +25,7 @@ func Disk(conf configuration.Conf) (configuration.Conf, error) {
 		Size:  len(disks),
 	}
 
-	i, _, err := prompt.Run()
+	i, _, err := runSelect(prompt)
 	if err != nil {
 		return configuration.Conf{}, SelectionStepError("Select Disk", err)
 	}
@@ -38,25 +42,364 @@ func DiskEncryption(conf configuration.Conf) (configuration.Conf, error) {
 	}
 
 	conf.Disk.EncryptionPasswd = SecretDialog("Encryption Password")
-	conf.Yubikey = YesNoDialog("Do you want to use a Yubikey for Encryption?")
-	if conf.Yubikey {
-		fmt.Println("Warning! You must have the Yubikey plugged and a slot configured for challenge response!")
+
+	// An explicit device like a swtpm also counts
+	if util.HasTPM2() || (conf.TPM2Device != "" && conf.TPM2Device != "auto") {
+		conf.TPM2 = YesNoDialog("Unlock the disk automatically with the TPM2? (the password stays as fallback)")
+		if conf.TPM2 {
+			pcrs, err := tpm2PCRsDialog(conf, "0+7")
+			if err != nil {
+				return configuration.Conf{}, SelectionStepError("Select TPM2 PCRs", err)
+			}
+			conf.TPM2PCRs = pcrs
+			return conf, nil
+		}
+	}
+
+	if YesNoDialog("Unlock the disk with FIDO2 security keys? (the password stays as fallback)") {
+		fmt.Fprintln(util.Out, "You will be asked to plug in each key and touch it during the installation")
 		prompt := promptui.Select{
-			Label:     "Select the challenge response slot",
-			Items:     []string{"1", "2"},
-			Size:      2,
-			CursorPos: 1,
+			Label: "How many FIDO2 keys do you want to enroll?",
+			Items: []string{"1", "2", "3", "4"},
+			Size:  4,
+		}
+		i, _, err := runSelect(prompt)
+		if err != nil {
+			return configuration.Conf{}, SelectionStepError("Select FIDO2 keys", err)
+		}
+		conf.FIDO2Keys = i + 1
+		return conf, nil
+	}
+
+	conf.Yubikey = YesNoDialog("Do you want to use a Yubikey for Encryption?")
+	if !conf.Yubikey {
+		return conf, nil
+	}
+
+	serial, err := util.YubikeySerial()
+	for err != nil {
+		fmt.Fprintln(util.Out, "No Yubikey found! Plug it in.")
+		if !ConfirmationDialog("Try again?") {
+			return configuration.Conf{}, SelectionStepError("Detect Yubikey", err)
+		}
+		serial, err = util.YubikeySerial()
+	}
+	fmt.Fprintf(util.Out, "Found Yubikey %s\n", serial)
+
+	prompt := promptui.Select{
+		Label:     "Select the challenge response slot",
+		Items:     []string{"1", "2"},
+		Size:      2,
+		CursorPos: 1,
+	}
+	i, _, err := runSelect(prompt)
+	if err != nil {
+		return configuration.Conf{}, SelectionStepError("Select Yubikey Slot", err)
+	}
+	conf.YubikeySlot = i + 1
+
+	configured := util.IsYubikeySlotConfigured(conf.YubikeySlot)
+	if !configured {
+		fmt.Fprintf(util.Out, "Slot %d is empty, it will be programmed for HMAC-SHA1 challenge response\n", conf.YubikeySlot)
+	}
+
+	conf.YubikeyBackup = YesNoDialog("Enroll a second Yubikey as backup?")
+	if conf.YubikeyBackup && configured {
+		// The secret of a configured slot can't be read back to copy it to the backup
+		conf.YubikeyBackup = YesNoDialog(fmt.Sprintf(
+			"Both keys need the same secret. Overwrite slot %d of Yubikey %s?", conf.YubikeySlot, serial))
+	}
+
+	if !configured || conf.YubikeyBackup {
+		conf.YubikeySecret = util.RandomHex(20)
+	}
+
+	conf.YubikeySalt = util.RandomHex(16)
+
+	return conf, nil
+}
+
+// EncryptionPassword asks again for the password when resuming,
+// the checkpoint doesn't store it
+func EncryptionPassword(conf configuration.Conf) (configuration.Conf, error) {
+	if conf.Disk.Encrypt {
+		conf.Disk.EncryptionPasswd = SecretDialog("Encryption Password")
+	}
+	return conf, nil
+}
+
+func LuksParameters(conf configuration.Conf) (configuration.Conf, error) {
+	if !conf.Disk.Encrypt {
+		return conf, nil
+	}
+
+	fmt.Fprintln(util.Out, "Running cryptsetup benchmark...")
+	conf.Disk.LUKS = disk.BenchmarkLuksParams()
+	if !conf.Disk.LUKS.Benchmarked {
+		fmt.Fprintln(util.Out, "Benchmark failed, falling back to the default LUKS parameters")
+	}
+
+	if YesNoDialog(fmt.Sprintf("Use LUKS parameters %s?", conf.Disk.LUKS)) {
+		return conf, nil
+	}
+
+	validCipher, _ := regexp.Compile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	cipherPrompt := promptui.Prompt{
+		Label:   "Cipher",
+		Default: conf.Disk.LUKS.Cipher,
+		Validate: func(s string) error {
+			if !validCipher.MatchString(s) {
+				return fmt.Errorf("invalid cipher")
+			}
+			return nil
+		},
+	}
+	cipher, err := runPrompt(cipherPrompt)
+	if err != nil {
+		return configuration.Conf{}, SelectionStepError("LUKS cipher", err)
+	}
+	conf.Disk.LUKS.Cipher = cipher
+
+	keySizes := []int{256, 512}
+	keySizePrompt := promptui.Select{
+		Label: "Key size in bits",
+		Items: keySizes,
+		Size:  len(keySizes),
+	}
+	i, _, err := runSelect(keySizePrompt)
+	if err != nil {
+		return configuration.Conf{}, SelectionStepError("LUKS key size", err)
+	}
+	conf.Disk.LUKS.KeySize = keySizes[i]
+
+	pbkdfs := disk.PBKDFs()
+	pbkdfPrompt := promptui.Select{
+		Label: "PBKDF",
+		Items: pbkdfs,
+		Size:  len(pbkdfs),
+	}
+	i, _, err = runSelect(pbkdfPrompt)
+	if err != nil {
+		return configuration.Conf{}, SelectionStepError("LUKS PBKDF", err)
+	}
+	conf.Disk.LUKS.PBKDF = pbkdfs[i]
+
+	conf.Disk.LUKS.IterTimeMs, err = intDialog("Iteration time in ms", conf.Disk.LUKS.IterTimeMs, 100, 60000)
+	if err != nil {
+		return configuration.Conf{}, SelectionStepError("LUKS iteration time", err)
+	}
+
+	if conf.Disk.LUKS.IsArgon2() {
+		conf.Disk.LUKS.MemoryKiB, err = intDialog("Argon2 memory in KiB", conf.Disk.LUKS.MemoryKiB, disk.MinArgon2MemoryKiB, 4*disk.MaxArgon2MemoryKiB)
+		if err != nil {
+			return configuration.Conf{}, SelectionStepError("LUKS argon2 memory", err)
+		}
+	}
+
+	return conf, nil
+}
+
+func intDialog(label string, def, min, max int) (int, error) {
+	prompt := promptui.Prompt{
+		Label:   label,
+		Default: strconv.Itoa(def),
+		Validate: func(s string) error {
+			i, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			if i < min || i > max {
+				return fmt.Errorf("must be between %d and %d", min, max)
+			}
+			return nil
+		},
+	}
+
+	res, err := runPrompt(prompt)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(res)
+}
+
+func RecoveryPassphrase(conf configuration.Conf) (configuration.Conf, error) {
+	if !conf.Disk.Encrypt {
+		return conf, nil
+	}
+
+	if !YesNoDialog("Generate a recovery passphrase?") {
+		return conf, nil
+	}
+
+	prompt := promptui.Prompt{
+		Label: "File to escrow the recovery passphrase to (e.g. on a USB stick)",
+		Validate: func(s string) error {
+			if !filepath.IsAbs(s) {
+				return fmt.Errorf("must be an absolute path")
+			}
+			if !util.DoesDirExist(filepath.Dir(s)) {
+				return fmt.Errorf("%s doesn't exist", filepath.Dir(s))
+			}
+			if util.IsOnDisk(filepath.Dir(s), conf.Disk.Name) {
+				return fmt.Errorf("must not be on %s", conf.Disk.Name)
+			}
+			return nil
+		},
+	}
+
+	escrow, err := runPrompt(prompt)
+	if err != nil {
+		return configuration.Conf{}, SelectionStepError("Recovery escrow file", err)
+	}
+	conf.RecoveryEscrow = escrow
+
+	conf.Disk.RecoveryPasswd = util.GenerateRecoveryKey()
+	fmt.Fprintf(util.Out, "\nYour recovery passphrase, it is only shown this once:\n\n    %s\n\n", conf.Disk.RecoveryPasswd)
+
+	if YesNoDialog("Show the recovery passphrase as QR code?") {
+		err = util.ShowQRCode(conf.Disk.RecoveryPasswd)
+		if err != nil {
+			fmt.Fprintf(util.Out, "Unable to show the QR code: %s\n", err)
+		}
+	}
+
+	for !ConfirmationDialog("Did you write down the recovery passphrase?") {
+		fmt.Fprintln(util.Out, "Write it down, it won't be shown again!")
+	}
+
+	return conf, nil
+}
+
+func LuksHeader(conf configuration.Conf) (configuration.Conf, error) {
+	if !conf.Disk.Encrypt {
+		return conf, nil
+	}
+
+	notOnDisk := func(s string) error {
+		if !filepath.IsAbs(s) {
+			return fmt.Errorf("must be an absolute path")
 		}
-		i, _, err := prompt.Run()
+		if util.IsOnDisk(s, conf.Disk.Name) {
+			return fmt.Errorf("must not be on %s", conf.Disk.Name)
+		}
+		return nil
+	}
+
+	// systemd-cryptenroll can't handle detached headers
+	if !conf.TPM2 && conf.FIDO2Keys == 0 &&
+		YesNoDialog("Store the LUKS header on a separate device like a USB stick? (it is needed for every boot)") {
+		fmt.Fprintln(util.Out, "Warning! The device will be overwritten, prefer a stable path like /dev/disk/by-id/...")
+		prompt := promptui.Prompt{
+			Label: "Device for the LUKS header",
+			Validate: func(s string) error {
+				if !filepath.IsAbs(s) {
+					return fmt.Errorf("must be an absolute path")
+				}
+				on, err := util.DeviceIsOnDisk(s, conf.Disk.Name)
+				if err != nil {
+					return err
+				}
+				if on {
+					return fmt.Errorf("must not be on %s", conf.Disk.Name)
+				}
+				return nil
+			},
+		}
+		header, err := runPrompt(prompt)
+		if err != nil {
+			return configuration.Conf{}, SelectionStepError("LUKS header device", err)
+		}
+		conf.Disk.DetachedHeader = header
+	}
+
+	if !YesNoDialog("Backup the LUKS headers?") {
+		return conf, nil
+	}
+
+	prompt := promptui.Prompt{
+		Label: "Directory for the LUKS header backups (e.g. on a removable drive)",
+		Validate: func(s string) error {
+			if !util.DoesDirExist(s) {
+				return fmt.Errorf("%s doesn't exist", s)
+			}
+			return notOnDisk(s)
+		},
+	}
+	dir, err := runPrompt(prompt)
+	if err != nil {
+		return configuration.Conf{}, SelectionStepError("LUKS header backup", err)
+	}
+	conf.HeaderBackupDir = dir
+
+	return conf, nil
+}
+
+func Discard(conf configuration.Conf) (configuration.Conf, error) {
+	if !conf.Disk.SSD {
+		conf.Disk.Discard = false
+		return conf, nil
+	}
+
+	label := fmt.Sprintf("%s is an SSD. Enable TRIM?", conf.Disk.Name)
+	if conf.Disk.Encrypt {
+		label = fmt.Sprintf("%s is an SSD. Enable TRIM? (reveals which encrypted blocks are unused)", conf.Disk.Name)
+	}
+
+	conf.Disk.Discard = YesNoDialog(label)
+
+	return conf, nil
+}
+
+func SecureBoot(conf configuration.Conf) (configuration.Conf, error) {
+	// lanzaboote needs systemd-boot and the kernels on the ESP
+	if !conf.IsUEFI() || conf.EncryptedBoot() {
+		return conf, nil
+	}
+
+	conf.SecureBoot = YesNoDialog("Enable Secure Boot with lanzaboote?")
+	if !conf.SecureBoot {
+		return conf, nil
+	}
+
+	if _, err := conf.EnrolledTPM2PCRs(); conf.TPM2 && err != nil {
+		fmt.Fprintf(util.Out, "%v!\n", err)
+		pcrs, err := tpm2PCRsDialog(conf, "0+"+configuration.SECUREBOOTPCR)
 		if err != nil {
-			return configuration.Conf{}, SelectionStepError("Select Yubikey Slot", err)
+			return configuration.Conf{}, SelectionStepError("Select TPM2 PCRs", err)
 		}
-		conf.YubikeySlot = i + 1
+		conf.TPM2PCRs = pcrs
 	}
 
+	conf.SecureBootSetupMode = util.IsSecureBootSetupMode()
+	if !conf.SecureBootSetupMode {
+		fmt.Fprintln(util.Out, "The firmware is not in setup mode, the keys will be created but have to be enrolled manually with sbctl!")
+		return conf, nil
+	}
+
+	conf.EnrollKeys = YesNoDialog("The firmware is in setup mode. Enroll the keys (including Microsoft's) now?")
+
 	return conf, nil
 }
 
+// tpm2PCRsDialog only accepts PCRs the TPM2 key can be bound to during the installation
+func tpm2PCRsDialog(conf configuration.Conf, def string) (string, error) {
+	validPCRs, _ := regexp.Compile(`^[0-9]+(\+[0-9]+)*$`)
+	prompt := promptui.Prompt{
+		Label:   "PCRs to bind the TPM2 key to",
+		Default: def,
+		Validate: func(s string) error {
+			if !validPCRs.MatchString(s) {
+				return fmt.Errorf("invalid PCRs")
+			}
+			conf.TPM2PCRs = s
+			_, err := conf.EnrolledTPM2PCRs()
+			return err
+		},
+	}
+	return runPrompt(prompt)
+}
+
 func Username(conf configuration.Conf) (configuration.Conf, error) {
 	validUser, _ := regexp.Compile("^[a-z_][a-z0-9_-]*[$]?$")
 
@@ -70,7 +413,7 @@ func Username(conf configuration.Conf) (configuration.Conf, error) {
 		},
 	}
 
-	username, err := prompt.Run()
+	username, err := runPrompt(prompt)
 	if err != nil {
 		return configuration.Conf{}, SelectionStepError("Username", err)
 	}
@@ -102,7 +445,7 @@ func Hostname(conf configuration.Conf) (configuration.Conf, error) {
 		},
 	}
 
-	hostname, err := prompt.Run()
+	hostname, err := runPrompt(prompt)
 	if err != nil {
 		return configuration.Conf{}, SelectionStepError("Hostname", err)
 	}
@@ -126,7 +469,7 @@ func Timezone(conf configuration.Conf) (configuration.Conf, error) {
 		},
 	}
 
-	timezone, err := prompt.Run()
+	timezone, err := runPrompt(prompt)
 	if err != nil {
 		return configuration.Conf{}, SelectionStepError("Timezone", err)
 	}
@@ -142,7 +485,7 @@ func Keyboardlayout(conf configuration.Conf) (configuration.Conf, error) {
 		Default: "de",
 	}
 
-	layout, err := prompt.Run()
+	layout, err := runPrompt(prompt)
 	if err != nil {
 		return configuration.Conf{}, SelectionStepError("Keyboard layout", err)
 	}
@@ -161,7 +504,7 @@ func DesktopEnviroment(conf configuration.Conf) (configuration.Conf, error) {
 		Size:  len(dms),
 	}
 
-	i, _, err := prompt.Run()
+	i, _, err := runSelect(prompt)
 	if err != nil {
 		return configuration.Conf{}, SelectionStepError("Desktop Enviroment", err)
 	}
@@ -171,6 +514,91 @@ func DesktopEnviroment(conf configuration.Conf) (configuration.Conf, error) {
 	return conf, nil
 }
 
+func Layout(conf configuration.Conf) (configuration.Conf, error) {
+	layouts := configuration.Layouts()
+
+	prompt := promptui.Select{
+		Label: "Select the filesystem layout (impermanence puts / on a tmpfs)",
+		Items: layouts,
+		Size:  len(layouts),
+	}
+
+	i, _, err := runSelect(prompt)
+	if err != nil {
+		return configuration.Conf{}, SelectionStepError("Layout", err)
+	}
+
+	conf.Layout = layouts[i]
+
+	return conf, nil
+}
+
+func EncryptedBoot(conf configuration.Conf) (configuration.Conf, error) {
+	if !conf.CanEncryptBoot() {
+		return conf, nil
+	}
+
+	conf.Disk.InitrdKeyfile = YesNoDialog("Encrypt /boot too? GRUB asks for the password and a keyfile in the initrd unlocks the disk")
+	if conf.EncryptedBoot() && conf.LuksParams() != conf.Disk.LUKS {
+		fmt.Fprintf(util.Out, "GRUB only unlocks PBKDF2 keyslots, the disk is encrypted with %s\n", conf.LuksParams())
+	}
+
+	return conf, nil
+}
+
+func MountOptions(conf configuration.Conf) (configuration.Conf, error) {
+	mountpoints := []string{"/"}
+	if conf.IsImpermanent() {
+		mountpoints = append(mountpoints, conf.RootMountpoint())
+	}
+	if conf.HasBootPartition() {
+		mountpoints = append(mountpoints, conf.BootMountpoint())
+	}
+
+	defaults := map[string]string{
+		"/":    "noatime",
+		"/nix": "noatime",
+	}
+	if conf.IsImpermanent() {
+		defaults["/"] = "defaults,size=2G,mode=755"
+	}
+
+	validOptions, _ := regexp.Compile(`^[a-zA-Z0-9_=.:,-]*$`)
+
+	conf.MountOptions = map[string][]string{}
+	for _, mp := range mountpoints {
+		prompt := promptui.Prompt{
+			Label:   fmt.Sprintf("Mount options for %s (comma separated)", mp),
+			Default: defaults[mp],
+			Validate: func(s string) error {
+				if !validOptions.MatchString(s) {
+					return fmt.Errorf("invalid mount options")
+				}
+				return nil
+			},
+		}
+
+		options, err := runPrompt(prompt)
+		if err != nil {
+			return configuration.Conf{}, SelectionStepError("Mount options", err)
+		}
+
+		conf.MountOptions[mp] = SplitMountOptions(options)
+	}
+
+	return conf, nil
+}
+
+func SplitMountOptions(s string) (options []string) {
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		if o != "" {
+			options = append(options, o)
+		}
+	}
+	return
+}
+
 func GetSelections(c configuration.Conf, steps []SelectionStep) (conf configuration.Conf, err error) {
 	conf = c
 	for _, step := range steps {
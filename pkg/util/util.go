@@ -2,17 +2,32 @@ package util
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/itsyouonline/identityserver/credentials/password/keyderivation/crypt/sha512crypt"
 )
 
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// ShellQuote quotes s as a single shell word, it's left alone if that isn't needed
+func ShellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // https://www.gnu.org/software/bash/manual/html_node/Double-Quotes.html
 func EscapeBashDoubleQuotes(s string) string {
 	replacements := []string{"\\", "$", "`", "\""}
@@ -29,11 +44,18 @@ func RemoveLinebreaks(s string) string {
 	return re.ReplaceAllString(s, ``)
 }
 
+// Out receives the messages for the user, a frontend can replace it
+var Out io.Writer = os.Stdout
+
+// BeforeExit is called with the error ExitIfErr exits with
+var BeforeExit = func(err error) {}
+
 func ExitIfErr(err error) {
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Fprintln(Out, err.Error())
+		BeforeExit(err)
 		if strings.HasSuffix(err.Error(), "^C") {
-			fmt.Println("User Interruption")
+			fmt.Fprintln(Out, "User Interruption")
 			os.Exit(0)
 		}
 		os.Exit(1)
@@ -55,6 +77,25 @@ func GetFirstLineOfFile(path string) string {
 	return ""
 }
 
+func GetAvailableMemoryKiB() int {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kib, _ := strconv.Atoi(fields[1])
+			return kib
+		}
+	}
+
+	return 0
+}
+
 func DoesDirExist(path string) bool {
 	info, err := os.Stat(path)
 	if err != nil {
@@ -81,6 +122,36 @@ func IsUefiSystem() bool {
 	return DoesDirExist("/sys/firmware/efi/")
 }
 
+func YubikeySerial() (string, error) {
+	out, err := exec.Command("ykinfo", "-q", "-s").Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func IsYubikeySlotConfigured(slot int) bool {
+	out, err := exec.Command("ykinfo", "-q", fmt.Sprintf("-%d", slot)).Output()
+	return err == nil && strings.TrimSpace(string(out)) == "1"
+}
+
+func RandomHex(bytes int) string {
+	b := make([]byte, bytes)
+	_, err := rand.Read(b)
+	ExitIfErr(err)
+	return hex.EncodeToString(b)
+}
+
+func HasTPM2() bool {
+	return DoesDirExist("/sys/class/tpm/tpm0")
+}
+
+// efivars start with 4 bytes of attributes followed by the value
+func IsSecureBootSetupMode() bool {
+	data, err := os.ReadFile("/sys/firmware/efi/efivars/SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	if err != nil || len(data) < 5 {
+		return false
+	}
+	return data[4] == 1
+}
+
 func MountIsUsed() bool {
 	return exec.Command("mountpoint", "/mnt").Run() == nil
 }
@@ -88,11 +159,84 @@ func MountIsUsed() bool {
 func WasRunAsRoot() bool {
 	currentUser, err := user.Current()
 	if err != nil {
-		fmt.Printf("Unable to get current user: %s\n", err)
+		fmt.Fprintf(Out, "Unable to get current user: %s\n", err)
 	}
 	return currentUser.Username == "root"
 }
 
+// GenerateRecoveryKey uses the systemd-cryptenroll format, 256 bits as
+// 8 dash separated groups of 8 modhex characters which are keyboard layout safe
+func GenerateRecoveryKey() string {
+	const modhex = "cbdefghijklnrtuv"
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	ExitIfErr(err)
+
+	groups := []string{}
+	for i := 0; i < len(key); i += 4 {
+		group := ""
+		for _, b := range key[i : i+4] {
+			group += string(modhex[b>>4]) + string(modhex[b&0xf])
+		}
+		groups = append(groups, group)
+	}
+
+	return strings.Join(groups, "-")
+}
+
+// IsOnDisk checks if the filesystem containing path lives on the block device
+func IsOnDisk(path, disk string) bool {
+	out, err := exec.Command("findmnt", "-n", "-o", "SOURCE", "--target", path).Output()
+	if err != nil {
+		return false
+	}
+	// A subvolume or bind mount looks like /dev/sda2[/home]
+	source := strings.SplitN(strings.TrimSpace(string(out)), "[", 2)[0]
+
+	on, err := deviceOnDisk(source, disk)
+	return err == nil && on
+}
+
+// DeviceIsOnDisk checks if the block device is the disk or stacked on it,
+// like a partition or a LUKS mapping. Symlinks like /dev/disk/by-id are resolved.
+func DeviceIsOnDisk(device, disk string) (bool, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return false, fmt.Errorf("%s is not a block device", device)
+	}
+	return deviceOnDisk(resolved, disk)
+}
+
+// deviceOnDisk walks up from the device through partitions and LUKS mappings to the disks
+func deviceOnDisk(device, disk string) (bool, error) {
+	out, err := exec.Command("lsblk", "-n", "-r", "-s", "-o", "KNAME,PKNAME", device).Output()
+	if err != nil {
+		return false, fmt.Errorf("can't find the parents of %s: %w", device, err)
+	}
+	for _, name := range strings.Fields(string(out)) {
+		if name == disk {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func ShowQRCode(s string) error {
+	cmd := exec.Command("qrencode", "-t", "ANSIUTF8")
+	cmd.Stdin = strings.NewReader(s)
+	cmd.Stdout = Out
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
 func MkPasswd(key string) string {
 	hash, _ := sha512crypt.New().Generate([]byte(key), []byte{})
 	return hash
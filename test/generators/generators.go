@@ -25,6 +25,10 @@ func Disk() *rapid.Generator {
 			SizeGB:           Int(t, "Disk_SizeGB"),
 			Encrypt:          Bool(t, "Disk_Encrypt"),
 			EncryptionPasswd: String(t, "Disk_EncryptionPasswd"),
+			LUKS:             LuksParams().Draw(t, "Disk_LUKS").(disk.LuksParams),
+			InitrdKeyfile:    Bool(t, "Disk_InitrdKeyfile"),
+			SSD:              Bool(t, "Disk_SSD"),
+			Discard:          Bool(t, "Disk_Discard"),
 			PartitionTable:   rapid.SampledFrom([]disk.PartitionTable{disk.Gpt, disk.Mbr}).Draw(t, "Disk_Table").(disk.PartitionTable),
 			Partitions:       rapid.SliceOfN(Partition(), 0, 5).Draw(t, "Disk_Partitions").([]disk.Partition),
 		}
@@ -36,6 +40,19 @@ func Disk() *rapid.Generator {
 	})
 }
 
+func LuksParams() *rapid.Generator {
+	return rapid.Custom(func(t *rapid.T) disk.LuksParams {
+		return disk.LuksParams{
+			Cipher:     rapid.SampledFrom([]string{"aes-xts-plain64", "serpent-xts-plain64", "twofish-xts-plain64"}).Draw(t, "LuksParams_Cipher").(string),
+			KeySize:    rapid.SampledFrom([]int{256, 512}).Draw(t, "LuksParams_KeySize").(int),
+			Hash:       "sha512",
+			PBKDF:      rapid.SampledFrom(disk.PBKDFs()).Draw(t, "LuksParams_PBKDF").(string),
+			IterTimeMs: rapid.IntRange(100, 60000).Draw(t, "LuksParams_IterTimeMs").(int),
+			MemoryKiB:  rapid.IntRange(disk.MinArgon2MemoryKiB, disk.MaxArgon2MemoryKiB).Draw(t, "LuksParams_MemoryKiB").(int),
+		}
+	})
+}
+
 func Partition() *rapid.Generator {
 	return rapid.Custom(func(t *rapid.T) disk.Partition {
 		return disk.Partition{
@@ -47,6 +64,9 @@ func Partition() *rapid.Generator {
 			From:     String(t, "Partition_From"),
 			To:       String(t, "Partition_To"),
 			Bootable: Bool(t, "Partition_Bootable"),
+
+			Mountpoint:   rapid.SampledFrom([]string{"", "/", "/boot", "/home"}).Draw(t, "Partition_Mountpoint").(string),
+			MountOptions: rapid.SliceOfN(rapid.StringMatching(`[a-z=]+`), 0, 3).Draw(t, "Partition_MountOptions").([]string),
 		}
 	})
 }
@@ -69,6 +89,14 @@ func Configuration() *rapid.Generator {
 			NetInterfaces:  rapid.SliceOf(rapid.String()).Draw(t, "NetInterfaces").([]string),
 			Yubikey:        Bool(t, "Yubikey"),
 			YubikeySlot:    Int(t, "YubikeySlot"),
+			YubikeyBackup:  Bool(t, "YubikeyBackup"),
+			YubikeySecret:  rapid.StringMatching(`([0-9a-f]{40})?`).Draw(t, "YubikeySecret").(string),
+			TPM2:           Bool(t, "TPM2"),
+			TPM2Device:     rapid.SampledFrom([]string{"auto", "/dev/tpmrm0"}).Draw(t, "TPM2Device").(string),
+			TPM2PCRs:       rapid.StringMatching(`([0-68-9]|[0-9]{2,})(\+[0-9]+)*`).Draw(t, "TPM2PCRs").(string), // never PCR 7 alone, see selection
+			FIDO2Keys:      rapid.IntRange(0, 4).Draw(t, "FIDO2Keys").(int),
+			SecureBoot:     Bool(t, "SecureBoot"),
+			EnrollKeys:     Bool(t, "EnrollKeys"),
 		}
 	})
 }